@@ -19,7 +19,7 @@ func Run(cmd *cobra.Command, args []string) {
 	v.SetConfigFile(configFilePath)
 	err := v.ReadInConfig()
 	if err != nil {
-		logrus.Fatal("can't read v file error=(%v)", err)
+		logrus.Fatalf("can't read v file error=(%v)", err)
 	}
 	v.SetDefault("log_level", "debug")
 
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"github.com/fsnotify/fsnotify"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// watchCertificates watches the certificate, client CA and CRL files of the
+// tls entrypoints. A change in any of them goes through OnConfigChange like
+// a change in the config file, which makes the entrypoints load them again.
+func (e *Engine) watchCertificates(c *Config) {
+	files := make(map[string]bool)
+	for _, entryPointConfig := range c.EntryPoints {
+		if entryPointConfig.TLS == nil {
+			continue
+		}
+		certificates := append([]Certificate{{
+			CertFile: entryPointConfig.TLS.CertFile,
+			KeyFile:  entryPointConfig.TLS.KeyFile,
+		}}, entryPointConfig.TLS.Certificates...)
+		var paths []string
+		for _, certificate := range certificates {
+			paths = append(paths, certificate.CertFile, certificate.KeyFile)
+		}
+		if clientAuth := entryPointConfig.TLS.ClientAuth; clientAuth != nil {
+			paths = append(paths, clientAuth.CAFile, clientAuth.CRLFile)
+		}
+		for _, file := range paths {
+			if file != "" {
+				files[filepath.Clean(file)] = true
+			}
+		}
+	}
+
+	e.certMtx.Lock()
+	defer e.certMtx.Unlock()
+	e.certFiles = files
+	if len(files) == 0 {
+		return
+	}
+
+	if e.certWatcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.WithError(err).Error("unable to watch certificate files")
+			return
+		}
+		e.certWatcher = watcher
+		go e.handleCertificateEvents(watcher)
+	}
+	// Directories are watched instead of the files themselves, so files
+	// replaced by a rename (as most renewal tools do) are noticed too.
+	for file := range files {
+		if err := e.certWatcher.Add(filepath.Dir(file)); err != nil {
+			logrus.WithError(err).Errorf("unable to watch certificate file %s", file)
+		}
+	}
+}
+
+func (e *Engine) handleCertificateEvents(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			e.certMtx.RLock()
+			watched := e.certFiles[filepath.Clean(event.Name)]
+			e.certMtx.RUnlock()
+			if watched {
+				logrus.Infof("certificate file %s is changed", event.Name)
+				e.OnConfigChange(event)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Error("error in watching certificate files")
+		}
+	}
+}
+
+// certificateHosts returns the hosts of the https and grpc frontends, which
+// are the hosts tls entrypoints may obtain acme certificates for.
+func certificateHosts(c *Config) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, frontend := range c.Frontend {
+		if frontend.Protocol != "https" && frontend.Protocol != "grpc" {
+			continue
+		}
+		for _, condition := range frontend.Match {
+			host := condition.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.ToLower(host)
+			if host == "" || net.ParseIP(host) != nil || seen[host] {
+				continue
+			}
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,19 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCertificateHosts(t *testing.T) {
+	c := &Config{
+		Frontend: []*Frontend{
+			{Protocol: "https", Match: []MatchCondition{{Host: "app.example.com"}, {Host: "API.example.com:8443"}}},
+			{Protocol: "https", Match: []MatchCondition{{Host: "app.example.com"}, {Host: "127.0.0.1:8443"}, {Method: "GET"}}},
+			{Protocol: "http", Match: []MatchCondition{{Host: "plain.example.com"}}},
+			{Protocol: "grpc", Match: []MatchCondition{{Host: "rpc.example.com"}}},
+		},
+	}
+	assert.Equal(t, []string{"app.example.com", "api.example.com", "rpc.example.com"}, certificateHosts(c))
+}
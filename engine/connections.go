@@ -0,0 +1,90 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// isUpgrade reports whether request asks to switch the connection to
+// another protocol, e.g. a websocket handshake.
+func isUpgrade(request *Request) bool {
+	if request.HttpHeaders.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range request.HttpHeaders["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connectionCounters counts the upgraded connections open through each
+// frontend by its id. The engine keeps them across reloads, which build new
+// frontends while the connections of the old ones are still open.
+type connectionCounters struct {
+	mtx    sync.Mutex
+	counts map[string]*int64
+}
+
+// counter returns the count of the connections open through the frontend
+// with id.
+func (c *connectionCounters) counter(id string) *int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]*int64)
+	}
+	count, ok := c.counts[id]
+	if !ok {
+		count = new(int64)
+		c.counts[id] = count
+	}
+	return count
+}
+
+// acquireConnection counts an upgraded connection in active against max. It
+// returns false if the limit is already reached.
+func acquireConnection(active *int64, max int64) bool {
+	if atomic.AddInt64(active, 1) > max {
+		atomic.AddInt64(active, -1)
+		return false
+	}
+	return true
+}
+
+// trackConnection releases the connection acquired for a request once the
+// upgraded connection of its response is closed, or at once if the backend
+// did not switch protocols.
+func trackConnection(active *int64, response *Response) *Response {
+	release := func() { atomic.AddInt64(active, -1) }
+	if response == nil || response.HttpStatus != http.StatusSwitchingProtocols {
+		release()
+		return response
+	}
+	conn, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		release()
+		return response
+	}
+	response.Body = &trackedConn{ReadWriteCloser: conn, release: release}
+	return response
+}
+
+type trackedConn struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"bytes"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+type upgradingProxy struct{}
+
+type nopConn struct {
+	bytes.Buffer
+}
+
+func (c *nopConn) Close() error { return nil }
+
+func (upgradingProxy) Handle(request *Request) (*Response, error) {
+	return &Response{HttpStatus: http.StatusSwitchingProtocols, Body: &nopConn{}}, nil
+}
+
+func TestConnectionLimit(t *testing.T) {
+	frontend := &Frontend{
+		Protocol:       "websocket",
+		Match:          []MatchCondition{{}},
+		Id:             "1",
+		MaxConnections: 1,
+		Destination:    &Backend{ReverseProxy: upgradingProxy{}},
+	}
+	c := &Config{Frontend: []*Frontend{frontend}}
+	e := &Engine{config: c, router: newRouter(c.Frontend)}
+	handshake := func() *Response {
+		return e.Handle(&Request{
+			Protocol:    "websocket",
+			URL:         "ws://localhost:9000/chat",
+			HttpHeaders: http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive, Upgrade"}},
+		})
+	}
+
+	first := handshake()
+	if !assert.Equal(t, http.StatusSwitchingProtocols, first.HttpStatus) {
+		return
+	}
+	assert.Implements(t, (*io.ReadWriteCloser)(nil), first.Body, "upgraded connection should stay writable")
+	assert.Equal(t, http.StatusServiceUnavailable, handshake().HttpStatus, "connection limit is not applied")
+
+	first.Body.Close()
+	first.Body.Close()
+	assert.Equal(t, int64(0), *e.connections.counter(frontend.Id))
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake().HttpStatus, "closed connection is not released")
+}
+
+func TestConnectionLimitAcrossReload(t *testing.T) {
+	var mtx sync.Mutex
+	var conns []net.Conn
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		mtx.Lock()
+		conns = append(conns, conn)
+		mtx.Unlock()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	}))
+	defer func() {
+		backend.Close()
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	v := viper.New()
+	v.SetConfigType("yml")
+	err := v.ReadConfig(strings.NewReader(`
+frontend:
+  - protocol: websocket
+    match:
+        - pathPrefix: /chat
+    maxConnections: 1
+    destination: chat
+
+entryPoints:
+  - protocol: websocket
+    enabled: false
+
+backend:
+  - name: chat
+    discovery:
+      type: static
+      url: 127.0.0.1
+    host: ` + backend.Listener.Addr().String() + `
+    protocol: websocket
+`))
+	assert.NoError(t, err, "unable to read conf")
+	e, err := NewEngine(v)
+	if !assert.NoError(t, err, "unable to instantiate Engine") {
+		return
+	}
+	defer func() { closeBackends(e.config) }()
+	handshake := func() *Response {
+		ctx, cancel := context.WithCancel(context.Background())
+		return e.Handle(&Request{
+			Protocol:    "websocket",
+			Context:     ctx,
+			CtxCancel:   cancel,
+			URL:         "ws://localhost:9000/chat",
+			HttpHeaders: http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+		})
+	}
+
+	first := handshake()
+	if !assert.Equal(t, http.StatusSwitchingProtocols, first.HttpStatus) {
+		return
+	}
+	frontend := e.config.Frontend[0]
+	e.OnConfigChange(fsnotify.Event{})
+	if !assert.False(t, frontend == e.config.Frontend[0], "config is not reloaded") {
+		return
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, handshake().HttpStatus, "connection limit is reset by the reload")
+
+	first.Body.Close()
+	second := handshake()
+	if assert.Equal(t, http.StatusSwitchingProtocols, second.HttpStatus, "closed connection is not released") {
+		second.Body.Close()
+	}
+}
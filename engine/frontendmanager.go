@@ -5,72 +5,144 @@ import (
 	. "github.com/k3rn3l-p4n1c/apigateway"
 	"github.com/sirupsen/logrus"
 	"net/url"
+	"strings"
 )
 
-func (e Engine) findFrontend(r *Request) (*Frontend, error) {
-	for _, frontendConfig := range e.config.Frontend {
-		if isMatch(frontendConfig, r) {
-			return frontendConfig, nil
-		}
+func (e *Engine) findFrontend(r *Request) (*Frontend, error) {
+	e.routerMtx.RLock()
+	router := e.router
+	e.routerMtx.RUnlock()
+	frontend := router.find(r)
+	if frontend == nil {
+		return nil, errors.New("frontend does not match request")
 	}
-	return nil, errors.New("frontend does not match request")
+	return frontend, nil
 }
 
+// isRoutable reports whether requests of protocol are routed by frontends.
+func isRoutable(protocol string) bool {
+	switch protocol {
+	case "http", "https", "grpc", "websocket":
+		return true
+	}
+	return false
+}
+
+// isMatch checks the conditions of a single frontend against the request.
+// Requests are routed by the router; isMatch is the reference matcher its
+// tests and benchmarks compare it with.
 func isMatch(frontend *Frontend, r *Request) bool {
 	if r.Protocol != frontend.Protocol {
 		return false
 	}
-	switch r.Protocol {
-	case "http":
-		rUrl, err := url.Parse(r.URL)
-		if err != nil {
-			logrus.WithError(err).Debug("findFrontend error in parsing url")
-			return false
-		}
-		for _, condition := range frontend.Match {
-			if condition.Host != "" {
-				if condition.Host != rUrl.Host{
-					continue
-				}
-			}
-			if len(condition.Header) > 0 {
-				match := true
-				for k, v := range condition.Header {
-					if r.HttpHeaders.Get(k) != v {
-						match = false
-						break
-					}
-				}
-				if !match {
-					continue
-				}
-			}
-			if condition.Method != "" {
-				if condition.Method != r.HttpMethod {
-					continue
-				}
-			}
-			if len(condition.Query) > 0 {
-				match := true
-				for k, v := range condition.Query {
-					if rUrl.Query().Get(k) != v {
-						match = false
-						break
-					}
-				}
-				if !match {
-					continue
-				}
-			}
-
+	if !isRoutable(r.Protocol) {
+		logrus.WithField("protocol", r.Protocol).Debug("findFrontend invalid protocol error")
+		return false
+	}
+	rUrl, err := url.Parse(r.URL)
+	if err != nil {
+		logrus.WithError(err).Debug("findFrontend error in parsing url")
+		return false
+	}
+	target := newMatchTarget(r, rUrl)
+	for i := range frontend.Match {
+		if params, ok := target.match(&frontend.Match[i]); ok {
 			// is matched with one condition at least
+			r.PathParams = params
 			return true
 		}
+	}
+
+	// matched with no condition
+	return false
+}
+
+// matchTarget is a request with its url parsed once for all conditions.
+type matchTarget struct {
+	r     *Request
+	url   *url.URL
+	query url.Values
+}
+
+func newMatchTarget(r *Request, rUrl *url.URL) *matchTarget {
+	return &matchTarget{r: r, url: rUrl}
+}
+
+// match reports whether the request satisfies condition and returns the
+// path parameters the condition captured.
+func (t *matchTarget) match(condition *MatchCondition) (map[string]string, bool) {
+	if condition.Host != "" {
+		if condition.Host != t.url.Host {
+			return nil, false
+		}
+	}
+	params, ok := matchPath(condition, t.url.Path)
+	if !ok {
+		return nil, false
+	}
+	for k, v := range condition.Header {
+		if t.r.HttpHeaders.Get(k) != v {
+			return nil, false
+		}
+	}
+	if condition.Method != "" {
+		if condition.Method != t.r.HttpMethod {
+			return nil, false
+		}
+	}
+	if condition.GrpcService != "" || condition.GrpcMethod != "" {
+		service, method := grpcServiceMethod(t.url.Path)
+		if condition.GrpcService != "" && condition.GrpcService != service {
+			return nil, false
+		}
+		if condition.GrpcMethod != "" && condition.GrpcMethod != method {
+			return nil, false
+		}
+	}
+	if condition.ClientName != "" {
+		if !hasClientName(t.r.ClientIdentity, condition.ClientName) {
+			return nil, false
+		}
+	}
+	if len(condition.Query) > 0 {
+		if t.query == nil {
+			t.query = t.url.Query()
+		}
+		for k, v := range condition.Query {
+			if t.query.Get(k) != v {
+				return nil, false
+			}
+		}
+	}
+	return params, true
+}
+
+// grpcServiceMethod splits the path of a grpc call, /package.Service/Method,
+// into the fully qualified service name and the method name.
+func grpcServiceMethod(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	slash := strings.LastIndexByte(path, '/')
+	if slash < 0 {
+		return path, ""
+	}
+	return path[:slash], path[slash+1:]
+}
 
-		// matched with no condition
+// hasClientName reports whether the verified client certificate is issued
+// for name, either as its common name or as one of its alternative names.
+func hasClientName(identity *ClientIdentity, name string) bool {
+	if identity == nil {
 		return false
-	default:
-		logrus.WithField("protocol", r.Protocol).Debug("findFrontend invalid protocol error")
+	}
+	if identity.CommonName == name {
+		return true
+	}
+	for _, names := range [][]string{identity.DNSNames, identity.EmailAddresses, identity.URIs} {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
 	}
 	return false
 }
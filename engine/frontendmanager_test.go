@@ -86,6 +86,7 @@ func TestFindFrontend(t *testing.T) {
 	}
 	e := Engine{
 		config: c,
+		router: newRouter(c.Frontend),
 	}
 
 	t.Run("TestMatchWithHost", func(t *testing.T) {
@@ -136,3 +137,103 @@ func TestFindFrontend(t *testing.T) {
 		}
 	})
 }
+
+func TestFrontendMatchClientName(t *testing.T) {
+	frontend := &Frontend{
+		Protocol: "https",
+		Match: []MatchCondition{{
+			Host:       "partners.example.com",
+			ClientName: "acme.partner.example.com",
+		}},
+	}
+	request := &Request{
+		Protocol: "https",
+		URL:      "https://partners.example.com/orders",
+	}
+	assert.False(t, isMatch(frontend, request), "request without client certificate should not match")
+
+	request.ClientIdentity = &ClientIdentity{CommonName: "evil"}
+	assert.False(t, isMatch(frontend, request), "other clients should not match")
+
+	request.ClientIdentity = &ClientIdentity{CommonName: "acme", DNSNames: []string{"acme.partner.example.com"}}
+	assert.True(t, isMatch(frontend, request), "client alternative name should match")
+}
+
+func TestFrontendMatchGrpc(t *testing.T) {
+	frontend := &Frontend{
+		Protocol: "grpc",
+		Match: []MatchCondition{
+			{GrpcService: "grpc.health.v1.Health", GrpcMethod: "Check"},
+			{GrpcService: "shop.v1.Orders"},
+		},
+	}
+	for url, expected := range map[string]bool{
+		"grpc://localhost:50051/grpc.health.v1.Health/Check": true,
+		"grpc://localhost:50051/grpc.health.v1.Health/Watch": false,
+		"grpc://localhost:50051/shop.v1.Orders/Create":       true,
+		"grpc://localhost:50051/shop.v1.Orders.Admin/Create": false,
+	} {
+		assert.Equal(t, expected, isMatch(frontend, &Request{Protocol: "grpc", URL: url}), "wrong match for %s", url)
+	}
+	assert.False(t, isMatch(frontend, &Request{Protocol: "http", URL: "http://localhost/shop.v1.Orders/Create"}),
+		"http request should not match grpc frontend")
+}
+
+func TestFrontendMatchPath(t *testing.T) {
+	match := func(condition MatchCondition, path string) (*Request, bool) {
+		request := &Request{Protocol: "http", URL: "http://app.example.com" + path}
+		return request, isMatch(&Frontend{Protocol: "http", Match: []MatchCondition{condition}}, request)
+	}
+
+	t.Run("TestExact", func(t *testing.T) {
+		_, ok := match(MatchCondition{Path: "/api/users"}, "/api/users")
+		assert.True(t, ok)
+		_, ok = match(MatchCondition{Path: "/api/users"}, "/api/users/1")
+		assert.False(t, ok, "exact path should not match sub paths")
+	})
+
+	t.Run("TestPrefix", func(t *testing.T) {
+		for path, expected := range map[string]bool{
+			"/api":         true,
+			"/api/":        true,
+			"/api/users":   true,
+			"/apiv2/users": false,
+			"/":            false,
+		} {
+			_, ok := match(MatchCondition{PathPrefix: "/api"}, path)
+			assert.Equal(t, expected, ok, "wrong prefix match for %s", path)
+		}
+	})
+
+	t.Run("TestTemplate", func(t *testing.T) {
+		request, ok := match(MatchCondition{Path: "/users/{id}/orders/{order:[0-9]{3}}"}, "/users/42/orders/123?x=1")
+		if assert.True(t, ok) {
+			assert.Equal(t, map[string]string{"id": "42", "order": "123"}, request.PathParams)
+		}
+		_, ok = match(MatchCondition{Path: "/users/{id}/orders/{order:[0-9]{3}}"}, "/users/42/orders/12a")
+		assert.False(t, ok, "parameter pattern is not applied")
+		_, ok = match(MatchCondition{Path: "/users/{id}"}, "/users/42/orders")
+		assert.False(t, ok, "parameter should match one segment")
+	})
+
+	t.Run("TestRegex", func(t *testing.T) {
+		request, ok := match(MatchCondition{PathPrefix: "/files", PathRegex: `^/files/(?P<name>.+)\.(?P<ext>png|jpg)$`}, "/files/a/b.png")
+		if assert.True(t, ok) {
+			assert.Equal(t, map[string]string{"name": "a/b", "ext": "png"}, request.PathParams)
+		}
+		_, ok = match(MatchCondition{PathRegex: `^/files/.+\.png$`}, "/files/a.gif")
+		assert.False(t, ok)
+	})
+
+	t.Run("TestInvalid", func(t *testing.T) {
+		for _, condition := range []MatchCondition{
+			{Path: "/users/{id"},
+			{Path: "/users/{}"},
+			{Path: "/users/{bad-name}"},
+			{PathRegex: "(unclosed"},
+		} {
+			err := validatePaths([]*Frontend{{Match: []MatchCondition{condition}}})
+			assert.Error(t, err, "%+v should be rejected", condition)
+		}
+	})
+}
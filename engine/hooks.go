@@ -0,0 +1,119 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chainMiddlewares passes the requests of each middleware of frontend to
+// the next one, and those of the last one to its backend.
+func chainMiddlewares(frontend *Frontend) {
+	for i, middleware := range frontend.Middlewares {
+		if i+1 < len(frontend.Middlewares) {
+			middleware.SetNext(link{frontend.Middlewares[i+1]})
+		} else {
+			middleware.SetNext(frontend.Destination.ReverseProxy)
+		}
+	}
+}
+
+// link runs the hooks of a middleware around its Handle. Middlewares are
+// chained through links, so the hooks of each middleware run in turn.
+type link struct {
+	middleware Middleware
+}
+
+func (l link) Handle(request *Request) (*Response, error) {
+	if hook, ok := l.middleware.(RequestHook); ok {
+		response, err := hook.OnRequest(request)
+		if response != nil || err != nil {
+			return response, err
+		}
+	}
+	response, err := l.middleware.Handle(request)
+	if err != nil {
+		hook, ok := l.middleware.(ErrorHook)
+		if !ok {
+			return response, err
+		}
+		handled, hookErr := hook.OnError(request, err)
+		if hookErr != nil {
+			return nil, hookErr
+		}
+		if handled == nil {
+			return response, err
+		}
+		response = handled
+	}
+	if hook, ok := l.middleware.(ResponseHook); ok && response != nil {
+		return hook.OnResponse(request, response)
+	}
+	return response, nil
+}
+
+// completeHooks returns the complete hooks of middlewares in the order they
+// are called.
+func completeHooks(middlewares []Middleware) []CompleteHook {
+	var hooks []CompleteHook
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if hook, ok := middlewares[i].(CompleteHook); ok {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// trackCompletion calls hooks once the body of response is closed, which
+// the entry points do after writing it, or at once if it has no body.
+func trackCompletion(hooks []CompleteHook, request *Request, start time.Time, response *Response) *Response {
+	if len(hooks) == 0 || response == nil {
+		return response
+	}
+	complete := func(sent int64) {
+		completion := Completion{BytesSent: sent, Duration: time.Since(start)}
+		for _, hook := range hooks {
+			hook.OnComplete(request, response, completion)
+		}
+	}
+	if response.Body == nil {
+		complete(0)
+		return response
+	}
+	body := &completedBody{ReadCloser: response.Body, complete: complete}
+	// an upgraded connection is written to as well
+	if conn, ok := response.Body.(io.ReadWriteCloser); ok {
+		response.Body = &completedConn{completedBody: body, Writer: conn}
+	} else {
+		response.Body = body
+	}
+	return response
+}
+
+// completedBody counts the bytes read from a body, which the entry points
+// write to the client before reading more.
+type completedBody struct {
+	io.ReadCloser
+	sent     int64
+	once     sync.Once
+	complete func(sent int64)
+}
+
+func (b *completedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.sent, int64(n))
+	return n, err
+}
+
+func (b *completedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.complete(atomic.LoadInt64(&b.sent)) })
+	return err
+}
+
+type completedConn struct {
+	*completedBody
+	io.Writer
+}
@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordingMiddleware records its hooks in events.
+type recordingMiddleware struct {
+	NextHandler
+	name      string
+	events    *[]string
+	onRequest *Response
+	onError   *Response
+}
+
+func (m *recordingMiddleware) OnRequest(request *Request) (*Response, error) {
+	*m.events = append(*m.events, m.name+" request")
+	return m.onRequest, nil
+}
+
+func (m *recordingMiddleware) OnResponse(request *Request, response *Response) (*Response, error) {
+	*m.events = append(*m.events, m.name+" response")
+	response.HttpHeaders.Add("X-Hooks", m.name)
+	return response, nil
+}
+
+func (m *recordingMiddleware) OnError(request *Request, err error) (*Response, error) {
+	*m.events = append(*m.events, m.name+" error "+err.Error())
+	return m.onError, nil
+}
+
+func (m *recordingMiddleware) OnComplete(request *Request, response *Response, completion Completion) {
+	*m.events = append(*m.events, fmt.Sprintf("%s complete %d %d", m.name, response.HttpStatus, completion.BytesSent))
+}
+
+type stubProxy struct {
+	calls int
+	body  string
+	err   error
+}
+
+func (p *stubProxy) Handle(request *Request) (*Response, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Response{
+		HttpStatus:  http.StatusOK,
+		HttpHeaders: http.Header{},
+		Body:        ioutil.NopCloser(strings.NewReader(p.body)),
+	}, nil
+}
+
+func textResponse(status int, body string) *Response {
+	return &Response{
+		HttpStatus:  status,
+		HttpHeaders: http.Header{},
+		Body:        ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestMiddlewareHooks(t *testing.T) {
+	var events []string
+	proxy := &stubProxy{body: "hello"}
+	first := &recordingMiddleware{name: "first", events: &events}
+	second := &recordingMiddleware{name: "second", events: &events}
+	frontend := &Frontend{
+		Protocol:    "http",
+		Match:       []MatchCondition{{}},
+		Destination: &Backend{ReverseProxy: proxy},
+		Middlewares: []Middleware{first, second},
+	}
+	chainMiddlewares(frontend)
+	c := &Config{Frontend: []*Frontend{frontend}}
+	e := &Engine{config: c, router: newRouter(c.Frontend)}
+	handle := func() *Response {
+		events = nil
+		response := e.Handle(&Request{
+			Protocol:    "http",
+			Context:     context.Background(),
+			URL:         "http://localhost:9000/",
+			HttpHeaders: http.Header{},
+			HttpMethod:  "GET",
+		})
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		response.Body.Close()
+		return response
+	}
+
+	response := handle()
+	assert.Equal(t, http.StatusOK, response.HttpStatus)
+	assert.Equal(t, []string{"second", "first"}, response.HttpHeaders["X-Hooks"])
+	assert.Equal(t, []string{
+		"first request", "second request",
+		"second response", "first response",
+		"second complete 200 5", "first complete 200 5",
+	}, events)
+
+	// a response of a request hook is sent without passing the request on
+	second.onRequest = textResponse(http.StatusForbidden, "no")
+	response = handle()
+	assert.Equal(t, http.StatusForbidden, response.HttpStatus)
+	assert.Equal(t, 1, proxy.calls, "request is passed on after a request hook responded")
+	assert.Equal(t, []string{
+		"first request", "second request",
+		"first response",
+		"second complete 403 2", "first complete 403 2",
+	}, events)
+	second.onRequest = nil
+
+	// an error hook turns the error into a response
+	proxy.err = errors.New("backend is down")
+	second.onError = textResponse(http.StatusBadGateway, "bad gateway")
+	response = handle()
+	assert.Equal(t, http.StatusBadGateway, response.HttpStatus)
+	assert.Equal(t, []string{
+		"first request", "second request",
+		"second error backend is down", "second response", "first response",
+		"second complete 502 11", "first complete 502 11",
+	}, events)
+
+	// an error no hook handles is an internal error
+	second.onError = nil
+	response = handle()
+	assert.Equal(t, http.StatusInternalServerError, response.HttpStatus)
+	assert.Equal(t, []string{
+		"first request", "second request",
+		"second error backend is down", "first error backend is down",
+		"second complete 500 25", "first complete 500 25",
+	}, events)
+}
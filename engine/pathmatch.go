@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// pathPatterns caches the compiled path templates and regexes of the
+// frontends, keyed by "template:" or "regex:" and the pattern.
+var pathPatterns sync.Map
+
+func isPathTemplate(path string) bool {
+	return strings.ContainsRune(path, '{')
+}
+
+// compilePathPattern returns the compiled regexp of a path template or of a
+// path regex, compiling it only the first time it is used.
+func compilePathPattern(pattern string, template bool) (*regexp.Regexp, error) {
+	key := "regex:" + pattern
+	if template {
+		key = "template:" + pattern
+	}
+	if re, ok := pathPatterns.Load(key); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	expr := pattern
+	if template {
+		var err error
+		if expr, err = templateRegexp(pattern); err != nil {
+			return nil, err
+		}
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path pattern %s. error=%v", pattern, err)
+	}
+	pathPatterns.Store(key, re)
+	return re, nil
+}
+
+// templateRegexp converts a path template to a regexp. {name} matches one
+// path segment and {name:pattern} matches pattern.
+func templateRegexp(template string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for rest := template; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return "", fmt.Errorf("unbalanced braces in path template %s", template)
+			}
+			b.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		b.WriteString(regexp.QuoteMeta(rest[:open]))
+		end := closingBrace(rest, open)
+		if end < 0 {
+			return "", fmt.Errorf("unbalanced braces in path template %s", template)
+		}
+		name, pattern := rest[open+1:end], "[^/]+"
+		if colon := strings.IndexByte(name, ':'); colon >= 0 {
+			name, pattern = name[:colon], name[colon+1:]
+		}
+		if name == "" {
+			return "", fmt.Errorf("unnamed parameter in path template %s", template)
+		}
+		b.WriteString("(?P<" + name + ">" + pattern + ")")
+		rest = rest[end+1:]
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// closingBrace returns the index of the brace closing the one at open, so
+// patterns like {id:[0-9]{4}} keep their own braces.
+func closingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// matchPath reports whether path satisfies the path matchers of condition
+// and returns the parameters they captured.
+func matchPath(condition *MatchCondition, path string) (map[string]string, bool) {
+	var params map[string]string
+	if condition.Path != "" {
+		if !isPathTemplate(condition.Path) {
+			if condition.Path != path {
+				return nil, false
+			}
+		} else if !matchPathPattern(condition.Path, true, path, &params) {
+			return nil, false
+		}
+	}
+	if condition.PathPrefix != "" && !hasPathPrefix(path, condition.PathPrefix) {
+		return nil, false
+	}
+	if condition.PathRegex != "" && !matchPathPattern(condition.PathRegex, false, path, &params) {
+		return nil, false
+	}
+	return params, true
+}
+
+func matchPathPattern(pattern string, template bool, path string, params *map[string]string) bool {
+	re, err := compilePathPattern(pattern, template)
+	if err != nil {
+		logrus.WithError(err).Debug("findFrontend invalid path pattern")
+		return false
+	}
+	values := re.FindStringSubmatch(path)
+	if values == nil {
+		return false
+	}
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if *params == nil {
+			*params = make(map[string]string)
+		}
+		(*params)[name] = values[i]
+	}
+	return true
+}
+
+// hasPathPrefix reports whether path starts with the path segments of
+// prefix. A prefix ending with a slash matches any path starting with it.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// validatePaths compiles the path templates and regexes of the frontends,
+// so invalid ones are reported when the config is loaded.
+func validatePaths(frontends []*Frontend) error {
+	for _, frontend := range frontends {
+		for _, condition := range frontend.Match {
+			if isPathTemplate(condition.Path) {
+				if _, err := compilePathPattern(condition.Path, true); err != nil {
+					return err
+				}
+			}
+			if condition.PathRegex != "" {
+				if _, err := compilePathPattern(condition.PathRegex, false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
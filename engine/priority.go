@@ -0,0 +1,154 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"sort"
+)
+
+// path kinds by how specific they are
+const (
+	anyPath = iota
+	prefixPath
+	regexPath
+	templatePath
+	exactPath
+)
+
+func pathKind(condition *MatchCondition) int {
+	switch {
+	case condition.Path != "" && !isPathTemplate(condition.Path):
+		return exactPath
+	case condition.Path != "":
+		return templatePath
+	case condition.PathRegex != "":
+		return regexPath
+	case condition.PathPrefix != "":
+		return prefixPath
+	}
+	return anyPath
+}
+
+// predicates counts the conditions besides host and path.
+func predicates(condition *MatchCondition) int {
+	n := len(condition.Header) + len(condition.Query)
+	for _, value := range []string{condition.Method, condition.ClientName, condition.GrpcService, condition.GrpcMethod} {
+		if value != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// orderRoutes sorts routes in the order they are matched: by the priority
+// of their frontend, then by how specific their condition is, then by their
+// position in the config. The order of each route is set to its index.
+func orderRoutes(routes []*route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.frontend.Priority != b.frontend.Priority {
+			return a.frontend.Priority > b.frontend.Priority
+		}
+		if ka, kb := pathKind(a.condition), pathKind(b.condition); ka != kb {
+			return ka > kb
+		}
+		if la, lb := len(a.condition.PathPrefix), len(b.condition.PathPrefix); la != lb {
+			return la > lb
+		}
+		if ha, hb := a.condition.Host != "", b.condition.Host != ""; ha != hb {
+			return ha
+		}
+		if pa, pb := predicates(a.condition), predicates(b.condition); pa != pb {
+			return pa > pb
+		}
+		return a.order < b.order
+	})
+	for i, r := range routes {
+		r.order = i
+	}
+}
+
+// shadowedFrontends returns the frontends which can never match, because
+// every request one of their conditions matches is matched by a condition
+// of another frontend that comes first. For each shadowed frontend one of
+// the frontends shadowing it is returned as well.
+func shadowedFrontends(routes []*route) map[*Frontend]*Frontend {
+	shadowed := make(map[*Frontend]*Frontend)
+	reachable := make(map[*Frontend]bool)
+	for i, r := range routes {
+		var by *Frontend
+		for _, earlier := range routes[:i] {
+			if earlier.frontend != r.frontend &&
+				earlier.frontend.Protocol == r.frontend.Protocol &&
+				covers(earlier.condition, r.condition) {
+				by = earlier.frontend
+				break
+			}
+		}
+		if by == nil {
+			reachable[r.frontend] = true
+			delete(shadowed, r.frontend)
+		} else if !reachable[r.frontend] {
+			if _, ok := shadowed[r.frontend]; !ok {
+				shadowed[r.frontend] = by
+			}
+		}
+	}
+	return shadowed
+}
+
+// covers reports whether condition a matches every request b matches. It
+// only says so when it is certain, e.g. two different regexes are never
+// considered to cover each other.
+func covers(a, b *MatchCondition) bool {
+	if a.Host != "" && a.Host != b.Host {
+		return false
+	}
+	if a.Path != "" && a.Path != b.Path {
+		return false
+	}
+	if a.PathRegex != "" && a.PathRegex != b.PathRegex {
+		return false
+	}
+	if a.PathPrefix != "" {
+		literal := b.Path != "" && !isPathTemplate(b.Path)
+		if !(literal && hasPathPrefix(b.Path, a.PathPrefix)) &&
+			!(b.PathPrefix != "" && hasPathPrefix(b.PathPrefix, a.PathPrefix)) {
+			return false
+		}
+	}
+	for _, values := range [][2]string{
+		{a.Method, b.Method},
+		{a.ClientName, b.ClientName},
+		{a.GrpcService, b.GrpcService},
+		{a.GrpcMethod, b.GrpcMethod},
+	} {
+		if values[0] != "" && values[0] != values[1] {
+			return false
+		}
+	}
+	return containsAll(b.Header, a.Header) && containsAll(b.Query, a.Query)
+}
+
+func containsAll(m, subset map[string]string) bool {
+	for k, v := range subset {
+		if value, ok := m[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// warnUnreachableFrontends logs the frontends which can never match.
+func warnUnreachableFrontends(frontends []*Frontend) {
+	shadowed := shadowedFrontends(frontendRoutes(frontends))
+	for _, frontend := range frontends {
+		if len(frontend.Match) == 0 {
+			logrus.Warnf("frontend %s to %s can never match, it has no match condition",
+				frontend.Id, frontend.DestinationName)
+		} else if by, ok := shadowed[frontend]; ok {
+			logrus.Warnf("frontend %s to %s can never match, it is shadowed by frontend %s to %s",
+				frontend.Id, frontend.DestinationName, by.Id, by.DestinationName)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFrontendOrder(t *testing.T) {
+	frontends := []*Frontend{
+		{Id: "host", Protocol: "http", Match: []MatchCondition{{Host: "app.example.com"}}},
+		{Id: "prefix", Protocol: "http", Match: []MatchCondition{{PathPrefix: "/api"}}},
+		{Id: "longer-prefix", Protocol: "http", Match: []MatchCondition{{PathPrefix: "/api/users"}}},
+		{Id: "template", Protocol: "http", Match: []MatchCondition{{Path: "/api/users/{id}"}}},
+		{Id: "exact", Protocol: "http", Match: []MatchCondition{{Path: "/api/users/me"}}},
+	}
+	rt := newRouter(frontends)
+	for path, expected := range map[string]string{
+		"/":             "host",
+		"/api/orders":   "prefix",
+		"/api/users":    "longer-prefix",
+		"/api/users/42": "template",
+		"/api/users/me": "exact",
+	} {
+		frontend := rt.find(&Request{Protocol: "http", URL: "http://app.example.com" + path})
+		if assert.NotNil(t, frontend, "no frontend for %s", path) {
+			assert.Equal(t, expected, frontend.Id, "wrong frontend for %s", path)
+		}
+	}
+
+	frontends[0].Priority = 1
+	frontend := newRouter(frontends).find(&Request{Protocol: "http", URL: "http://app.example.com/api/users/me"})
+	if assert.NotNil(t, frontend) {
+		assert.Equal(t, "host", frontend.Id, "priority should come before specificity")
+	}
+}
+
+func TestShadowedFrontends(t *testing.T) {
+	catchAll := &Frontend{Id: "catch-all", Protocol: "http", Match: []MatchCondition{{Host: "app.example.com", PathPrefix: "/api"}}, Priority: 1}
+	shadowed := &Frontend{Id: "shadowed", Protocol: "http", Match: []MatchCondition{
+		{Host: "app.example.com", Path: "/api/users", Method: "GET"},
+		{Host: "app.example.com", PathPrefix: "/api/orders/"},
+	}}
+	partly := &Frontend{Id: "partly", Protocol: "http", Match: []MatchCondition{
+		{Host: "app.example.com", Path: "/api/users"},
+		{Host: "app.example.com", Path: "/status"},
+	}}
+	otherHost := &Frontend{Id: "other-host", Protocol: "http", Match: []MatchCondition{{Host: "other.example.com", PathPrefix: "/api"}}}
+	regex := &Frontend{Id: "regex", Protocol: "http", Match: []MatchCondition{{Host: "app.example.com", PathRegex: "^/apiv2"}}}
+	otherProtocol := &Frontend{Id: "https", Protocol: "https", Match: []MatchCondition{{Host: "app.example.com", PathPrefix: "/api"}}}
+
+	result := shadowedFrontends(frontendRoutes([]*Frontend{catchAll, shadowed, partly, otherHost, regex, otherProtocol}))
+	assert.Equal(t, map[*Frontend]*Frontend{shadowed: catchAll}, result)
+}
+
+func TestCovers(t *testing.T) {
+	for _, test := range []struct {
+		a, b     MatchCondition
+		expected bool
+	}{
+		{MatchCondition{}, MatchCondition{Host: "a", Path: "/x"}, true},
+		{MatchCondition{PathPrefix: "/api"}, MatchCondition{PathPrefix: "/api/"}, true},
+		{MatchCondition{PathPrefix: "/api/"}, MatchCondition{PathPrefix: "/api"}, false},
+		{MatchCondition{PathPrefix: "/api"}, MatchCondition{PathPrefix: "/apiv2"}, false},
+		{MatchCondition{PathPrefix: "/api"}, MatchCondition{Path: "/api/users/{id}"}, false},
+		{MatchCondition{Query: map[string]string{"v": "1"}}, MatchCondition{Query: map[string]string{"v": "1", "x": "2"}}, true},
+		{MatchCondition{Query: map[string]string{"v": "1"}}, MatchCondition{Query: map[string]string{"v": "2"}}, false},
+		{MatchCondition{Method: "GET"}, MatchCondition{}, false},
+	} {
+		assert.Equal(t, test.expected, covers(&test.a, &test.b), "covers(%+v, %+v)", test.a, test.b)
+	}
+}
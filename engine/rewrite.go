@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"net/url"
+	"strings"
+)
+
+// rewritePath applies the rewrite rules of frontend to the url of request.
+func rewritePath(request *Request, frontend *Frontend) error {
+	rewrite := frontend.Rewrite
+	u, err := url.Parse(request.URL)
+	if err != nil {
+		return err
+	}
+	path := u.Path
+
+	if rewrite.StripPrefix != "" && hasPathPrefix(path, rewrite.StripPrefix) {
+		path = path[len(rewrite.StripPrefix):]
+	}
+	if frontend.RewriteRegex != nil {
+		path = frontend.RewriteRegex.ReplaceAllString(path, rewrite.Replacement)
+	}
+	if rewrite.Template != "" {
+		if path, err = expandTemplate(rewrite.Template, request.PathParams); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if rewrite.AddPrefix != "" {
+		path = strings.TrimSuffix(rewrite.AddPrefix, "/") + path
+	}
+
+	u.Path = path
+	u.RawPath = ""
+	request.URL = u.String()
+	return nil
+}
+
+// expandTemplate replaces the {name} parameters of template by their values.
+func expandTemplate(template string, params map[string]string) (string, error) {
+	var b strings.Builder
+	for rest := template; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unbalanced braces in rewrite template %s", template)
+		}
+		name := rest[open+1 : open+end]
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("path parameter %s of rewrite template %s is not captured", name, template)
+		}
+		b.WriteString(rest[:open])
+		b.WriteString(value)
+		rest = rest[open+end+1:]
+	}
+	return b.String(), nil
+}
+
+// templateParams returns the parameter names of a rewrite template.
+func templateParams(template string) ([]string, error) {
+	var names []string
+	for rest := template; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 || end == 1 {
+			return nil, fmt.Errorf("invalid parameter in rewrite template %s", template)
+		}
+		names = append(names, rest[open+1:open+end])
+		rest = rest[open+end+1:]
+	}
+	return names, nil
+}
+
+// capturedParams returns the names of the path parameters condition captures.
+func capturedParams(condition MatchCondition) map[string]bool {
+	captured := make(map[string]bool)
+	add := func(pattern string, template bool) {
+		re, err := compilePathPattern(pattern, template)
+		if err != nil {
+			return
+		}
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				captured[name] = true
+			}
+		}
+	}
+	if isPathTemplate(condition.Path) {
+		add(condition.Path, true)
+	}
+	if condition.PathRegex != "" {
+		add(condition.PathRegex, false)
+	}
+	return captured
+}
+
+// validateRewrites checks the rewrite rules of the frontends and compiles
+// their regexes. Every parameter of a template must be captured by all match
+// conditions, as any of them may be the one a request matched.
+func validateRewrites(frontends []*Frontend) error {
+	for _, frontend := range frontends {
+		rewrite := frontend.Rewrite
+		if rewrite == nil {
+			continue
+		}
+		if rewrite.Regex != "" {
+			re, err := compilePathPattern(rewrite.Regex, false)
+			if err != nil {
+				return err
+			}
+			frontend.RewriteRegex = re
+		}
+		if rewrite.Template == "" {
+			continue
+		}
+		names, err := templateParams(rewrite.Template)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 && len(frontend.Match) == 0 {
+			return fmt.Errorf("rewrite template %s uses path parameters no path matcher captures", rewrite.Template)
+		}
+		for _, condition := range frontend.Match {
+			captured := capturedParams(condition)
+			for _, name := range names {
+				if !captured[name] {
+					return fmt.Errorf("path parameter %s of rewrite template %s is not captured", name, rewrite.Template)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rewrite  Rewrite
+		url      string
+		params   map[string]string
+		expected string
+	}{
+		{"StripPrefix", Rewrite{StripPrefix: "/api"}, "http://app.example.com/api/users?page=2", nil, "http://app.example.com/users?page=2"},
+		{"StripWholePath", Rewrite{StripPrefix: "/api"}, "http://app.example.com/api", nil, "http://app.example.com/"},
+		{"StripOtherSegment", Rewrite{StripPrefix: "/api"}, "http://app.example.com/apiv2/users", nil, "http://app.example.com/apiv2/users"},
+		{"AddPrefix", Rewrite{AddPrefix: "/v1/"}, "http://app.example.com/users", nil, "http://app.example.com/v1/users"},
+		{"StripAndAdd", Rewrite{StripPrefix: "/api", AddPrefix: "/internal"}, "http://app.example.com/api/users", nil, "http://app.example.com/internal/users"},
+		{"Regex", Rewrite{Regex: `^/users/(\d+)/avatar$`, Replacement: "/avatars/$1.png"}, "http://app.example.com/users/42/avatar", nil, "http://app.example.com/avatars/42.png"},
+		{"Template", Rewrite{Template: "/v2/accounts/{id}/orders/{order}"}, "http://app.example.com/users/42/orders/7?x=1",
+			map[string]string{"id": "42", "order": "7"}, "http://app.example.com/v2/accounts/42/orders/7?x=1"},
+		{"TemplateEscapes", Rewrite{Template: "/files/{name}"}, "http://app.example.com/f/a",
+			map[string]string{"name": "a b"}, "http://app.example.com/files/a%20b"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			frontend := &Frontend{Rewrite: &test.rewrite}
+			if test.rewrite.Regex != "" {
+				frontend.RewriteRegex, _ = compilePathPattern(test.rewrite.Regex, false)
+			}
+			request := &Request{URL: test.url, PathParams: test.params}
+			if assert.NoError(t, rewritePath(request, frontend)) {
+				assert.Equal(t, test.expected, request.URL)
+			}
+		})
+	}
+}
+
+func TestValidateRewrites(t *testing.T) {
+	frontend := func(rewrite Rewrite, match ...MatchCondition) []*Frontend {
+		return []*Frontend{{Match: match, Rewrite: &rewrite}}
+	}
+	assert.NoError(t, validateRewrites(frontend(Rewrite{Template: "/v2/{id}"},
+		MatchCondition{Path: "/users/{id}"}, MatchCondition{PathRegex: `^/u/(?P<id>\d+)$`})))
+	assert.Error(t, validateRewrites(frontend(Rewrite{Template: "/v2/{id}"},
+		MatchCondition{Path: "/users/{id}"}, MatchCondition{PathPrefix: "/u"})), "parameter not captured by every condition")
+	assert.Error(t, validateRewrites(frontend(Rewrite{Template: "/v2/{id}"})), "parameter without path matcher")
+	assert.Error(t, validateRewrites(frontend(Rewrite{Template: "/v2/{}"}, MatchCondition{Path: "/users/{id}"})))
+	assert.Error(t, validateRewrites(frontend(Rewrite{Regex: "(unclosed"})))
+
+	frontends := frontend(Rewrite{Regex: `^/users/(\d+)$`})
+	if assert.NoError(t, validateRewrites(frontends)) && assert.NotNil(t, frontends[0].RewriteRegex) {
+		assert.Equal(t, "/u/42", frontends[0].RewriteRegex.ReplaceAllString("/users/42", "/u/$1"))
+	}
+}
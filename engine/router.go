@@ -0,0 +1,173 @@
+package engine
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// router finds the frontend of a request without checking every frontend.
+// Match conditions are indexed by protocol, host and path; the conditions
+// left after the lookup are checked in the order of orderRoutes, so the
+// result is the same as checking all conditions in that order.
+// A router is built once per config and never changed.
+type router struct {
+	protocols map[string]*hostIndex
+}
+
+// route is one match condition of a frontend. order is the position of the
+// condition in the match order.
+type route struct {
+	frontend  *Frontend
+	condition *MatchCondition
+	order     int
+}
+
+type hostIndex struct {
+	byHost  map[string]*pathIndex
+	anyHost *pathIndex
+}
+
+// pathIndex holds routes by their exact path, by their path prefix in a
+// tree of path segments, and the routes which do not constrain the path to
+// a literal, e.g. templates and regexes.
+type pathIndex struct {
+	exact  map[string][]*route
+	prefix *pathNode
+	other  []*route
+}
+
+type pathNode struct {
+	children map[string]*pathNode
+	routes   []*route
+}
+
+func newRouter(frontends []*Frontend) *router {
+	rt := &router{protocols: make(map[string]*hostIndex)}
+	routes := frontendRoutes(frontends)
+	for _, r := range routes {
+		hosts := rt.protocols[r.frontend.Protocol]
+		if hosts == nil {
+			hosts = &hostIndex{byHost: make(map[string]*pathIndex), anyHost: newPathIndex()}
+			rt.protocols[r.frontend.Protocol] = hosts
+		}
+		paths := hosts.anyHost
+		if host := r.condition.Host; host != "" {
+			if paths = hosts.byHost[host]; paths == nil {
+				paths = newPathIndex()
+				hosts.byHost[host] = paths
+			}
+		}
+		paths.add(r)
+	}
+	return rt
+}
+
+// frontendRoutes returns the match conditions of the routable frontends in
+// the order they are matched.
+func frontendRoutes(frontends []*Frontend) []*route {
+	var routes []*route
+	for _, frontend := range frontends {
+		if !isRoutable(frontend.Protocol) {
+			logrus.WithField("protocol", frontend.Protocol).Debug("frontend protocol is not routable")
+			continue
+		}
+		for i := range frontend.Match {
+			routes = append(routes, &route{frontend: frontend, condition: &frontend.Match[i], order: len(routes)})
+		}
+	}
+	orderRoutes(routes)
+	return routes
+}
+
+func newPathIndex() *pathIndex {
+	return &pathIndex{exact: make(map[string][]*route), prefix: &pathNode{}}
+}
+
+func (idx *pathIndex) add(r *route) {
+	switch {
+	case r.condition.Path != "" && !isPathTemplate(r.condition.Path):
+		idx.exact[r.condition.Path] = append(idx.exact[r.condition.Path], r)
+	case r.condition.PathPrefix != "":
+		node := idx.prefix
+		for _, segment := range prefixSegments(r.condition.PathPrefix) {
+			child := node.children[segment]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[string]*pathNode)
+				}
+				child = &pathNode{}
+				node.children[segment] = child
+			}
+			node = child
+		}
+		node.routes = append(node.routes, r)
+	default:
+		idx.other = append(idx.other, r)
+	}
+}
+
+// prefixSegments splits a path prefix into the segments of its tree node.
+// The tree only narrows the candidates, hasPathPrefix decides the match.
+func prefixSegments(prefix string) []string {
+	prefix = strings.TrimSuffix(strings.TrimPrefix(prefix, "/"), "/")
+	if prefix == "" {
+		return nil
+	}
+	return strings.Split(prefix, "/")
+}
+
+// candidates appends the routes whose path may match path.
+func (idx *pathIndex) candidates(routes []*route, path string) []*route {
+	routes = append(routes, idx.exact[path]...)
+	routes = append(routes, idx.other...)
+
+	node := idx.prefix
+	routes = append(routes, node.routes...)
+	for rest := strings.TrimPrefix(path, "/"); node.children != nil; {
+		segment := rest
+		slash := strings.IndexByte(rest, '/')
+		if slash >= 0 {
+			segment = rest[:slash]
+		}
+		if node = node.children[segment]; node == nil {
+			break
+		}
+		routes = append(routes, node.routes...)
+		if slash < 0 {
+			break
+		}
+		rest = rest[slash+1:]
+	}
+	return routes
+}
+
+func (rt *router) find(r *Request) *Frontend {
+	hosts := rt.protocols[r.Protocol]
+	if hosts == nil {
+		return nil
+	}
+	rUrl, err := url.Parse(r.URL)
+	if err != nil {
+		logrus.WithError(err).Debug("findFrontend error in parsing url")
+		return nil
+	}
+
+	var routes []*route
+	if paths := hosts.byHost[rUrl.Host]; paths != nil {
+		routes = paths.candidates(routes, rUrl.Path)
+	}
+	routes = hosts.anyHost.candidates(routes, rUrl.Path)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].order < routes[j].order })
+
+	target := newMatchTarget(r, rUrl)
+	for _, candidate := range routes {
+		if params, ok := target.match(candidate.condition); ok {
+			r.PathParams = params
+			return candidate.frontend
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// linearFind is the matcher the router replaces: every frontend is checked
+// in config order.
+func linearFind(frontends []*Frontend, r *Request) *Frontend {
+	for _, frontend := range frontends {
+		if isMatch(frontend, r) {
+			return frontend
+		}
+	}
+	return nil
+}
+
+// orderedFind checks the conditions of routes one by one without the index.
+func orderedFind(routes []*route, r *Request) *Frontend {
+	rUrl, err := url.Parse(r.URL)
+	if err != nil {
+		return nil
+	}
+	target := newMatchTarget(r, rUrl)
+	for _, route := range routes {
+		if route.frontend.Protocol != r.Protocol {
+			continue
+		}
+		if params, ok := target.match(route.condition); ok {
+			r.PathParams = params
+			return route.frontend
+		}
+	}
+	return nil
+}
+
+func TestRouterOrder(t *testing.T) {
+	frontends := []*Frontend{
+		{Id: "prefix", Protocol: "http", Match: []MatchCondition{{PathPrefix: "/api"}}},
+		{Id: "exact", Protocol: "http", Match: []MatchCondition{{Host: "app.example.com", Path: "/api/users"}}},
+		{Id: "template", Protocol: "http", Match: []MatchCondition{{Path: "/users/{id}"}}},
+		{Id: "any", Protocol: "http", Match: []MatchCondition{{Method: "DELETE"}, {}}},
+	}
+	rt := newRouter(frontends)
+	for url, expected := range map[string]string{
+		"http://app.example.com/api/users": "exact",
+		"http://app.example.com/api":       "prefix",
+		"http://app.example.com/apiv2":     "any",
+		"http://app.example.com/users/42":  "template",
+	} {
+		frontend := rt.find(&Request{Protocol: "http", URL: url})
+		if assert.NotNil(t, frontend, "no frontend for %s", url) {
+			assert.Equal(t, expected, frontend.Id, "wrong frontend for %s", url)
+		}
+	}
+
+	request := &Request{Protocol: "http", URL: "http://app.example.com/users/42"}
+	rt.find(request)
+	assert.Equal(t, map[string]string{"id": "42"}, request.PathParams)
+	assert.Nil(t, rt.find(&Request{Protocol: "grpc", URL: "grpc://app.example.com/api"}))
+}
+
+func TestRouterMatchesOrderedScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	hosts := []string{"", "a.example.com", "b.example.com"}
+	paths := []string{"/", "/api", "/api/", "/api/users", "/api/users/42", "/apiv2", "/files/a/b.png", ""}
+	pick := func(values []string) string { return values[random.Intn(len(values))] }
+
+	var frontends []*Frontend
+	for i := 0; i < 200; i++ {
+		frontend := &Frontend{
+			Id:       fmt.Sprint(i),
+			Protocol: []string{"http", "https"}[random.Intn(2)],
+			Priority: random.Intn(3) - 1,
+		}
+		for j := random.Intn(3); j >= 0; j-- {
+			condition := MatchCondition{Host: pick(hosts)}
+			switch random.Intn(5) {
+			case 0:
+				condition.Path = pick(paths)
+			case 1:
+				condition.PathPrefix = pick(paths)
+			case 2:
+				condition.Path = "/api/users/{id}"
+			case 3:
+				condition.PathRegex = `^/files/(?P<name>.+)\.png$`
+			}
+			if random.Intn(4) == 0 {
+				condition.Method = pick([]string{"GET", "POST"})
+			}
+			if random.Intn(4) == 0 {
+				condition.Query = map[string]string{"version": pick([]string{"1", "2"})}
+			}
+			if random.Intn(4) == 0 {
+				condition.Header = map[string]string{"X-Tenant": pick([]string{"acme", "other"})}
+			}
+			frontend.Match = append(frontend.Match, condition)
+		}
+		frontends = append(frontends, frontend)
+	}
+
+	rt := newRouter(frontends)
+	routes := frontendRoutes(frontends)
+	for i := 0; i < 2000; i++ {
+		newRequest := func() *Request {
+			return &Request{
+				Protocol:    []string{"http", "https"}[i%2],
+				URL:         fmt.Sprintf("http://%s%s?version=%d", pick(hosts[1:]), pick(paths), 1+i%3),
+				HttpMethod:  []string{"GET", "POST", "PUT"}[i%3],
+				HttpHeaders: http.Header{"X-Tenant": {[]string{"acme", "other"}[i%2]}},
+			}
+		}
+		request := newRequest()
+		linearRequest := *request
+
+		expected := orderedFind(routes, &linearRequest)
+		actual := rt.find(request)
+		if !assert.Equal(t, expected, actual, "router and ordered scan disagree on %s %s", request.HttpMethod, request.URL) {
+			return
+		}
+		assert.Equal(t, linearRequest.PathParams, request.PathParams)
+	}
+}
+
+// benchmarkFrontends returns n frontends with a host and a path prefix each,
+// and a request only the last of them matches.
+func benchmarkFrontends(n int) ([]*Frontend, *Request) {
+	var frontends []*Frontend
+	for i := 0; i < n; i++ {
+		frontends = append(frontends, &Frontend{
+			Protocol: "http",
+			Match: []MatchCondition{
+				{Host: fmt.Sprintf("app%d.example.com", i), PathPrefix: "/api"},
+				{Host: "shared.example.com", PathPrefix: fmt.Sprintf("/service%d", i), Query: map[string]string{"version": "1"}},
+			},
+		})
+	}
+	request := &Request{
+		Protocol:   "http",
+		URL:        fmt.Sprintf("http://shared.example.com/service%d/users?version=1", n-1),
+		HttpMethod: "GET",
+	}
+	return frontends, request
+}
+
+func BenchmarkFindFrontend(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		frontends, request := benchmarkFrontends(n)
+		b.Run(fmt.Sprintf("Linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if linearFind(frontends, request) == nil {
+					b.Fatal("no frontend found")
+				}
+			}
+		})
+		rt := newRouter(frontends)
+		b.Run(fmt.Sprintf("Router/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if rt.find(request) == nil {
+					b.Fatal("no frontend found")
+				}
+			}
+		})
+	}
+}
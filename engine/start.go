@@ -17,6 +17,10 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"errors"
 	"time"
+	"sync"
+	"strconv"
+	"io"
+	"strings"
 )
 
 const DefaultTimeout = 10 * time.Second
@@ -26,6 +30,18 @@ type Engine struct {
 	config      *Config
 	entryPoints map[string]entrypoint.Server
 	doneSignal  chan struct{}
+	reloadMtx   sync.Mutex
+
+	// routerMtx guards router, which is swapped on reload while requests
+	// are handled.
+	routerMtx sync.RWMutex
+	router    *router
+
+	certMtx     sync.RWMutex
+	certWatcher *fsnotify.Watcher
+	certFiles   map[string]bool
+
+	connections connectionCounters
 }
 
 func NewEngine(v *viper.Viper) (*Engine, error) {
@@ -51,6 +67,9 @@ func NewEngine(v *viper.Viper) (*Engine, error) {
 }
 
 func (e *Engine) OnConfigChange(_ fsnotify.Event) {
+	e.reloadMtx.Lock()
+	defer e.reloadMtx.Unlock()
+
 	logrus.Info("reloading config")
 	var config = Config{}
 	err := e.viper.Unmarshal(&config)
@@ -85,7 +104,7 @@ func (e *Engine) Start() {
 		logrus.Info("got signal:", killSignal)
 
 		for protocol, entryPoint := range e.entryPoints {
-			logrus.Info("killing %s", protocol)
+			logrus.Infof("killing %s", protocol)
 			entryPoint.Close()
 		}
 	case <-finished:
@@ -105,6 +124,7 @@ func (e *Engine) loadConfig(c *Config) error {
 	}
 
 	name2service := make(map[string]*Backend)
+	proxies := make(map[*Backend]ReverseProxy)
 	for _, backend := range c.Backend {
 		name2service[backend.Name] = backend
 		if backend.Timeout == 0 {
@@ -120,65 +140,95 @@ func (e *Engine) loadConfig(c *Config) error {
 			return fmt.Errorf("no backend for name %s", frontend.DestinationName)
 		}
 	}
+	if err := validatePaths(c.Frontend); err != nil {
+		return err
+	}
+	if err := validateRewrites(c.Frontend); err != nil {
+		return err
+	}
+	for i, frontend := range c.Frontend {
+		if frontend.Id == "" {
+			frontend.Id = strconv.Itoa(i + 1)
+		}
+	}
+	warnUnreachableFrontends(c.Frontend)
+
+	for _, frontend := range c.Frontend {
+		if err := initReverseProxy(frontend.Destination, name2service, proxies); err != nil {
+			closeBackends(c)
+			return fmt.Errorf("fail to initialize reverse proxy for backend error=%v", err)
+		}
+	}
 
 	for _, frontend := range c.Frontend {
 		for _, middlewareName := range frontend.MiddlewareNames {
-			middleware := middlewares.Middlewares[middlewareName]
-			if len(frontend.Middlewares) > 0 {
-				frontend.Middlewares[len(frontend.Middlewares)-1].SetNext(middleware)
+			middleware, err := newMiddleware(middlewareName, c.Middlewares)
+			if err != nil {
+				closeBackends(c)
+				return fmt.Errorf("fail to initialize middleware %s of frontend %s. error=%v", middlewareName, frontend.Id, err)
 			}
 			frontend.Middlewares = append(frontend.Middlewares, middleware)
 		}
-		var err error
-		if frontend.Destination.Discovery.Type == "dns" {
-			frontend.Destination.Discovery.Url = frontend.Destination.Host
-		}
-		frontend.Destination.ReverseProxy, err = reproxy.New(frontend.Destination)
-		if err != nil {
-			return fmt.Errorf("fail to initialize reverse proxy for backend error=%v", err)
-		}
-		if len(frontend.Middlewares) > 0 {
-			frontend.Middlewares[len(frontend.Middlewares)-1].SetNext(frontend.Destination.ReverseProxy)
-		}
+		chainMiddlewares(frontend)
 	}
 
+	// the entrypoints are built to validate their config and closed right
+	// away, which stops what they built, e.g. acme managers
 	for _, entryPointConfig := range c.EntryPoints {
-		_, err := entrypoint.New(entryPointConfig, func(request *Request) *Response { return nil })
+		if entryPointConfig.Enabled != nil && !*entryPointConfig.Enabled {
+			continue
+		}
+		entryPoint, err := entrypoint.New(entryPointConfig, func(request *Request) *Response { return nil })
 		if err != nil {
 			logrus.WithError(err).Errorf("error in initializing server %s", entryPointConfig.Protocol)
+			closeBackends(c)
 			return fmt.Errorf("error in initializing server %s. error=%v", entryPointConfig.Protocol, err)
 		}
+		entryPoint.Close()
 	}
 
+	previous := e.config
 	e.config = c
+	router := newRouter(c.Frontend)
+	e.routerMtx.Lock()
+	e.router = router
+	e.routerMtx.Unlock()
+	reproxy.SetRetryBudget(c.RetryBudget)
+	if previous != nil {
+		closeBackends(previous)
+	}
+	e.watchCertificates(c)
 	// ok
 	for _, entryPointConfig := range c.EntryPoints {
 		entryPoint, exists := e.entryPoints[entryPointConfig.Protocol]
 		if exists {
 			if entryPoint.EqualConfig(entryPointConfig) {
+				if reloader, ok := entryPoint.(entrypoint.CertificateReloader); ok {
+					if err := reloader.ReloadCertificates(); err != nil {
+						logrus.WithError(err).Errorf("unable to reload certificates of %s entry point", entryPointConfig.Protocol)
+					}
+				}
 				logrus.Infof("no need to reload %s entry point", entryPointConfig.Protocol)
 				continue
 			} else {
+				logrus.Infof("killing %s", entryPointConfig.Protocol)
+				entryPoint.Close()
+				delete(e.entryPoints, entryPointConfig.Protocol)
 				if entryPointConfig.Enabled != nil && *entryPointConfig.Enabled == false {
-					logrus.Infof("killing &s", entryPointConfig.Protocol)
-					entryPoint.Close()
-					delete(e.entryPoints, entryPointConfig.Protocol)
+					continue
 				}
 				newEntryPoint, err := entrypoint.New(entryPointConfig, e.Handle)
 				if err != nil {
 					logrus.WithError(err).Errorf("unable to create %s server.", entryPointConfig.Protocol)
 					continue
 				}
-				entryPoint.Close()
-				newEntryPoint.Start()
 				e.entryPoints[entryPointConfig.Protocol] = newEntryPoint
 				go func() {
-					defer entryPoint.Close()
-					err = entryPoint.Start()
+					defer newEntryPoint.Close()
+					err := newEntryPoint.Start()
 					logrus.WithError(err).Info("server is shutting down.")
 					e.doneSignal <- struct{}{}
 				}()
-
 			}
 		} else {
 			if entryPointConfig.Enabled == nil {
@@ -205,6 +255,13 @@ func (e *Engine) loadConfig(c *Config) error {
 			}()
 		}
 	}
+
+	hosts := certificateHosts(c)
+	for _, entryPoint := range e.entryPoints {
+		if s, ok := entryPoint.(entrypoint.CertificateHosts); ok {
+			s.SetCertificateHosts(hosts)
+		}
+	}
 	return nil
 }
 
@@ -227,10 +284,38 @@ func (e *Engine) Handle(request *Request) (resp *Response) {
 		}
 	}
 
+	if frontend.Rewrite != nil {
+		if err := rewritePath(request, frontend); err != nil {
+			logrus.WithError(err).Error("error in rewriting path")
+			return &Response{
+				HttpStatus: http.StatusInternalServerError,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("apigateway internal error")),
+			}
+		}
+	}
+
+	if frontend.MaxConnections > 0 && isUpgrade(request) {
+		active := e.connections.counter(frontend.Id)
+		if !acquireConnection(active, frontend.MaxConnections) {
+			logrus.Warnf("too many connections to frontend of %s", frontend.DestinationName)
+			return &Response{
+				HttpStatus: http.StatusServiceUnavailable,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("too many connections")),
+			}
+		}
+		defer func() { resp = trackConnection(active, resp) }()
+	}
+
 	if len(frontend.Middlewares) > 0 {
-		resp, err = frontend.Middlewares[0].Handle(request)
+		hooks, start := completeHooks(frontend.Middlewares), time.Now()
+		defer func() { resp = trackCompletion(hooks, request, start, resp) }()
+		resp, err = link{frontend.Middlewares[0]}.Handle(request)
 		if err != nil {
 			logrus.WithError(err).Error("error in middleware")
+			if resp != nil {
+				// e.g. the bad gateway or gateway timeout of the proxy
+				return resp
+			}
 			return &Response{
 				HttpStatus: http.StatusInternalServerError,
 				Body:       ioutil.NopCloser(bytes.NewBufferString("apigateway internal error")),
@@ -248,6 +333,9 @@ func (e *Engine) Handle(request *Request) (resp *Response) {
 		logrus.Debug("no middleware")
 		if err != nil {
 			logrus.WithError(err).Error("error in reverse proxy")
+			if resp != nil {
+				return resp
+			}
 			return &Response{
 				HttpStatus: http.StatusInternalServerError,
 				Body:       ioutil.NopCloser(bytes.NewBufferString("apigateway internal error")),
@@ -256,3 +344,76 @@ func (e *Engine) Handle(request *Request) (resp *Response) {
 	}
 	return
 }
+
+// initReverseProxy creates the reverse proxy of backend and of its fallback
+// backend. A backend shared by frontends has one reverse proxy, so its
+// health checks, load balancing and circuit breaker see all of its requests.
+// proxies keeps the reverse proxies without their circuit breakers.
+func initReverseProxy(backend *Backend, name2service map[string]*Backend, proxies map[*Backend]ReverseProxy) error {
+	if backend.ReverseProxy != nil {
+		return nil
+	}
+	if backend.Discovery.Type == "dns" && backend.Discovery.Url == "" {
+		backend.Discovery.Url = backend.Host
+	}
+	if (backend.Discovery.Type == "consul" || backend.Discovery.Type == "kubernetes") && backend.Discovery.Service == "" {
+		backend.Discovery.Service = backend.Name
+	}
+	proxy, err := reproxy.New(backend)
+	if err != nil {
+		return err
+	}
+	backend.ReverseProxy = proxy
+	proxies[backend] = proxy
+	if backend.CircuitBreaker == nil {
+		return nil
+	}
+
+	var fallback ReverseProxy
+	if name := backend.CircuitBreaker.Fallback.Backend; name != "" {
+		fallbackBackend := name2service[name]
+		if fallbackBackend == nil || fallbackBackend == backend {
+			return fmt.Errorf("no fallback backend for name %s", name)
+		}
+		// the fallback is called without its circuit breaker, so backends
+		// falling back to each other do not fall back in a loop
+		if err := initReverseProxy(fallbackBackend, name2service, proxies); err != nil {
+			return err
+		}
+		fallback = proxies[fallbackBackend]
+	}
+	backend.ReverseProxy = reproxy.NewCircuitBreaker(backend, proxy, fallback)
+	return nil
+}
+
+// newMiddleware builds a new instance of the middleware definition name,
+// so each frontend has its own. A name without definition is a middleware
+// type without parameters.
+func newMiddleware(name string, definitions map[string]map[string]interface{}) (Middleware, error) {
+	middlewareType := name
+	params := make(map[string]interface{})
+	for key, value := range definitions[strings.ToLower(name)] {
+		if strings.ToLower(key) == "type" {
+			t, ok := value.(string)
+			if !ok || t == "" {
+				return nil, fmt.Errorf("invalid type of middleware %s", name)
+			}
+			middlewareType = t
+			continue
+		}
+		params[key] = value
+	}
+	return middlewares.New(middlewareType, params)
+}
+
+// closeBackends stops the background work of the reverse proxies of the
+// backends in c, e.g. health checks.
+func closeBackends(c *Config) {
+	for _, backend := range c.Backend {
+		if closer, ok := backend.ReverseProxy.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logrus.WithError(err).Warnf("unable to close reverse proxy of backend %s", backend.Name)
+			}
+		}
+	}
+}
@@ -8,6 +8,23 @@ import (
 	"net/http"
 	"io/ioutil"
 	"time"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"io"
+	"fmt"
+	"net/http/httptest"
+	"context"
+	"github.com/k3rn3l-p4n1c/apigateway/middlewares"
+	"sync"
 )
 
 func TestInstantiating(t *testing.T) {
@@ -69,3 +86,371 @@ backend:
 		assert.Equal(t, string(body1), string(body2), "apigateway response body is not equal example.com")
 	}
 }
+
+func writeCertificate(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+}
+
+func servedSerial(addr string) (*big.Int, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "app.example.com"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber, nil
+}
+
+func TestCertificateHotReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "app.crt"), filepath.Join(dir, "app.key")
+	writeCertificate(t, certFile, keyFile, "app.example.com")
+
+	v := viper.New()
+	config := `
+frontend:
+  - protocol: https
+    match:
+        - host: app.example.com
+    destination: example
+
+entryPoints:
+  - protocol: https
+    addr: 127.0.0.1:9444
+    tls:
+      certFile: ` + certFile + `
+      keyFile: ` + keyFile + `
+
+backend:
+  - name: example
+    discovery:
+      type: dns
+    host: example.com
+    protocol: http
+`
+	v.SetConfigType("yml")
+	err := v.ReadConfig(strings.NewReader(config))
+	assert.NoError(t, err, "unable to read conf")
+
+	e, err := NewEngine(v)
+	if !assert.NoError(t, err, "unable to instantiate Engine") {
+		return
+	}
+	defer e.entryPoints["https"].Close()
+
+	var before *big.Int
+	for i := 0; i < 50 && before == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		before, _ = servedSerial("127.0.0.1:9444")
+	}
+	if !assert.NotNil(t, before, "https entry point is not serving") {
+		return
+	}
+
+	writeCertificate(t, certFile, keyFile, "app.example.com")
+	var after *big.Int
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+		after, err = servedSerial("127.0.0.1:9444")
+		if err == nil && after.Cmp(before) != 0 {
+			break
+		}
+	}
+	assert.NotEqual(t, before, after, "certificate is not reloaded after the file changed")
+}
+
+func TestInitReverseProxy(t *testing.T) {
+	// the backends always fail and count their requests
+	var mtx sync.Mutex
+	hits := make(map[string]int)
+	var servers []*httptest.Server
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	backend := func(name, fallback string) *Backend {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			hits[name]++
+			mtx.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		servers = append(servers, server)
+		b := &Backend{
+			Name:      name,
+			Protocol:  "http",
+			Scheme:    "http",
+			Host:      server.Listener.Addr().String(),
+			Discovery: Discovery{Type: "static", Url: "127.0.0.1"},
+			Timeout:   DefaultTimeout,
+		}
+		if fallback != "" {
+			b.CircuitBreaker = &CircuitBreaker{MinRequests: 1, OpenTimeout: time.Hour, Fallback: Fallback{Backend: fallback}}
+		}
+		return b
+	}
+	name2service := map[string]*Backend{
+		"primary":   backend("primary", "secondary"),
+		"secondary": backend("secondary", "primary"),
+		"broken":    backend("broken", "missing"),
+	}
+	proxies := make(map[*Backend]ReverseProxy)
+	defer closeBackends(&Config{Backend: []*Backend{name2service["primary"], name2service["secondary"], name2service["broken"]}})
+
+	// backends falling back to each other are created once each
+	if !assert.NoError(t, initReverseProxy(name2service["primary"], name2service, proxies)) {
+		return
+	}
+	assert.NotNil(t, name2service["primary"].ReverseProxy)
+	assert.NotNil(t, name2service["secondary"].ReverseProxy)
+	secondary := name2service["secondary"].ReverseProxy
+	assert.NoError(t, initReverseProxy(name2service["secondary"], name2service, proxies))
+	assert.Equal(t, secondary, name2service["secondary"].ReverseProxy)
+	_, ok := name2service["primary"].ReverseProxy.(io.Closer)
+	assert.True(t, ok, "circuit breaker does not close the reverse proxy")
+
+	call := func(name string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		response, err := name2service[name].ReverseProxy.Handle(&Request{
+			Protocol:    "http",
+			Context:     ctx,
+			CtxCancel:   cancel,
+			URL:         "http://" + name + "/",
+			Body:        ioutil.NopCloser(strings.NewReader("")),
+			HttpHeaders: http.Header{},
+			HttpMethod:  "GET",
+		})
+		if assert.NoError(t, err) {
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+	}
+	// both circuits open, then each backend falls back to the other one
+	// without its open circuit, whichever was created first
+	call("primary")
+	call("secondary")
+	call("primary")
+	call("secondary")
+	mtx.Lock()
+	assert.Equal(t, map[string]int{"primary": 2, "secondary": 2}, hits)
+	mtx.Unlock()
+
+	err := initReverseProxy(name2service["broken"], name2service, proxies)
+	assert.EqualError(t, err, "no fallback backend for name missing")
+}
+
+// tagMiddleware appends its tag to the X-Chain header of requests.
+type tagMiddleware struct {
+	tag  string
+	next Handler
+}
+
+func (m *tagMiddleware) Handle(request *Request) (*Response, error) {
+	request.HttpHeaders.Add("X-Chain", m.tag)
+	return m.next.Handle(request)
+}
+
+func (m *tagMiddleware) SetNext(handler Handler) {
+	m.next = handler
+}
+
+func registerTagMiddleware() {
+	middlewares.Register("tag", func(decode func(params interface{}) error) (Middleware, error) {
+		var params struct{ Tag string }
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return &tagMiddleware{tag: params.Tag}, nil
+	})
+}
+
+func TestFrontendMiddlewares(t *testing.T) {
+	registerTagMiddleware()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header["X-Chain"], ","))
+	}))
+	defer server.Close()
+
+	config := func(definitions string) *viper.Viper {
+		v := viper.New()
+		v.SetConfigType("yml")
+		err := v.ReadConfig(strings.NewReader(`
+frontend:
+  - protocol: http
+    match:
+        - host: a.local
+    destination: echo
+    middlewares: [first, second]
+  - protocol: http
+    match:
+        - host: b.local
+    destination: echo
+    middlewares: [second]
+
+entryPoints:
+  - protocol: http
+    enabled: false
+
+backend:
+  - name: echo
+    discovery:
+      type: static
+      url: 127.0.0.1
+    host: ` + server.Listener.Addr().String() + `
+    protocol: http
+
+middlewares:
+` + definitions))
+		assert.NoError(t, err, "unable to read conf")
+		return v
+	}
+
+	e, err := NewEngine(config(`
+  first:
+    type: tag
+    tag: one
+  second:
+    type: tag
+    tag: two
+`))
+	if !assert.NoError(t, err, "unable to instantiate Engine") {
+		return
+	}
+	defer closeBackends(e.config)
+	assert.Empty(t, e.entryPoints, "disabled entrypoint is started")
+
+	frontends := e.config.Frontend
+	if assert.Len(t, frontends[0].Middlewares, 2) && assert.Len(t, frontends[1].Middlewares, 1) {
+		// the middlewares are chained in order, then to the backend
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		resp := e.Handle(&Request{
+			Protocol:    "http",
+			Context:     ctx,
+			CtxCancel:   cancel,
+			URL:         "http://a.local/",
+			Body:        ioutil.NopCloser(strings.NewReader("")),
+			HttpHeaders: http.Header{},
+			HttpMethod:  "GET",
+		})
+		if assert.Equal(t, http.StatusOK, resp.HttpStatus) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "one,two", string(body))
+		}
+		// each frontend has its own instance of a middleware
+		assert.False(t, frontends[0].Middlewares[1] == frontends[1].Middlewares[0], "frontends share a middleware instance")
+	}
+
+	for definitions, message := range map[string]string{
+		"  first:\n    type: tag\n":                                           "middleware second is not supported",
+		"  first:\n    type: tag\n  second:\n    type: missing\n":             "middleware missing is not supported",
+		"  first:\n    type: tag\n    color: red\n  second:\n    type: tag\n": "invalid parameters of middleware tag",
+	} {
+		_, err := NewEngine(config(definitions))
+		if assert.Error(t, err, fmt.Sprintf("middlewares %q are accepted", definitions)) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	registerTagMiddleware()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	v := viper.New()
+	v.SetConfigType("yml")
+	err := v.ReadConfig(strings.NewReader(`
+frontend:
+  - protocol: http
+    match:
+        - host: dead.local
+    destination: dead
+  - protocol: http
+    match:
+        - host: slow.local
+    destination: slow
+  - protocol: http
+    match:
+        - host: tagged.local
+    destination: slow
+    middlewares: [tagged]
+
+entryPoints:
+  - protocol: http
+    enabled: false
+
+backend:
+  - name: dead
+    discovery:
+      type: static
+      url: 127.0.0.1
+    host: ` + dead.Listener.Addr().String() + `
+    protocol: http
+  - name: slow
+    discovery:
+      type: static
+      url: 127.0.0.1
+    host: ` + slow.Listener.Addr().String() + `
+    protocol: http
+    timeout: 50ms
+
+middlewares:
+  tagged:
+    type: tag
+    tag: one
+`))
+	assert.NoError(t, err, "unable to read conf")
+	e, err := NewEngine(v)
+	if !assert.NoError(t, err, "unable to instantiate Engine") {
+		return
+	}
+	defer closeBackends(e.config)
+
+	for host, status := range map[string]int{
+		"dead.local":   http.StatusBadGateway,
+		"slow.local":   http.StatusGatewayTimeout,
+		"tagged.local": http.StatusGatewayTimeout,
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		resp := e.Handle(&Request{
+			Protocol:    "http",
+			Context:     ctx,
+			CtxCancel:   cancel,
+			URL:         "http://" + host + "/",
+			Body:        ioutil.NopCloser(strings.NewReader("")),
+			HttpHeaders: http.Header{},
+			HttpMethod:  "GET",
+		})
+		assert.Equal(t, status, resp.HttpStatus, "status of %s", host)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,138 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// acmeManager obtains certificates from an ACME server for the hosts which
+// are routed by the frontends and keeps them in a local directory.
+type acmeManager struct {
+	config  *ACME
+	manager *autocert.Manager
+
+	mtx        sync.RWMutex
+	hosts      map[string]bool
+	httpServer *http.Server
+}
+
+func newACMEManager(config *ACME) (*acmeManager, error) {
+	if config.CacheDir == "" {
+		return nil, errors.New("cacheDir is not set for acme")
+	}
+	a := &acmeManager{
+		config: config,
+		hosts:  make(map[string]bool),
+	}
+
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.CAFile != "" {
+		// test servers like pebble serve their directory with their own ca
+		caPem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read acme ca file %s. error=%v", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in acme ca file %s", config.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	a.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  a.hostPolicy,
+		Client:      client,
+		Email:       config.Email,
+		RenewBefore: config.RenewBefore,
+	}
+	return a, nil
+}
+
+// setHosts replaces the hosts certificates may be requested for.
+func (a *acmeManager) setHosts(hosts []string) {
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		allowed[strings.ToLower(host)] = true
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.hosts = allowed
+}
+
+func (a *acmeManager) allows(host string) bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return a.hosts[strings.ToLower(host)]
+}
+
+func (a *acmeManager) hostPolicy(_ context.Context, host string) error {
+	if !a.allows(host) {
+		return fmt.Errorf("acme: host %s is not routed by any frontend", host)
+	}
+	return nil
+}
+
+func (a *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.manager.GetCertificate(hello)
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to get acme certificate for %s", hello.ServerName)
+	}
+	return cert, err
+}
+
+// isChallenge reports whether hello is the tls-alpn-01 validation request
+// of the ACME server.
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// startHTTPChallenge serves http-01 challenges on HTTPChallengeAddr. Other
+// requests on that address are redirected to https.
+func (a *acmeManager) startHTTPChallenge() error {
+	if a.config.HTTPChallengeAddr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", a.config.HTTPChallengeAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s for acme http challenge. error=%v", a.config.HTTPChallengeAddr, err)
+	}
+	server := &http.Server{Handler: a.manager.HTTPHandler(nil)}
+	a.mtx.Lock()
+	a.httpServer = server
+	a.mtx.Unlock()
+
+	logrus.Infof("start listening on %s for acme http challenge", a.config.HTTPChallengeAddr)
+	go func() {
+		err := server.Serve(listener)
+		logrus.WithError(err).Info("acme http challenge server is shutting down.")
+	}()
+	return nil
+}
+
+func (a *acmeManager) close() error {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	if a.httpServer == nil {
+		return nil
+	}
+	return a.httpServer.Close()
+}
@@ -0,0 +1,123 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/tls"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestACMEHostPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+
+	a, err := newACMEManager(&ACME{DirectoryURL: "https://localhost:14000/dir", CacheDir: dir})
+	if !assert.NoError(t, err, "error in instantiating acme manager") {
+		return
+	}
+	assert.Error(t, a.hostPolicy(context.Background(), "app.example.com"), "hosts are not allowed before they are set")
+
+	a.setHosts([]string{"app.example.com", "API.example.com"})
+	assert.NoError(t, a.hostPolicy(context.Background(), "app.example.com"))
+	assert.NoError(t, a.hostPolicy(context.Background(), "api.example.com"))
+	assert.Error(t, a.hostPolicy(context.Background(), "evil.example.com"))
+
+	a.setHosts([]string{"api.example.com"})
+	assert.Error(t, a.hostPolicy(context.Background(), "app.example.com"), "removed hosts should not be allowed")
+
+	_, err = newACMEManager(&ACME{DirectoryURL: "https://localhost:14000/dir"})
+	assert.Error(t, err, "acme without cache directory should be rejected")
+}
+
+func TestCertificateStoreWithACME(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "static", "static.example.com")
+
+	store, err := newCertificateStore(&TLS{
+		ACME: &ACME{DirectoryURL: "https://localhost:14000/dir", CacheDir: dir},
+	})
+	if !assert.NoError(t, err, "acme should not need static certificates") {
+		return
+	}
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	assert.Error(t, err, "hosts of no frontend should not get a certificate")
+
+	store, err = newCertificateStore(&TLS{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		ACME:     &ACME{DirectoryURL: "https://localhost:14000/dir", CacheDir: dir},
+	})
+	if !assert.NoError(t, err, "error in loading certificates") {
+		return
+	}
+	store.acme.setHosts([]string{"static.example.com"})
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "static.example.com"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "static.example.com", cert.Leaf.Subject.CommonName, "static certificate should be preferred")
+	}
+
+	config, err := newTLSConfig(store.config, store)
+	if assert.NoError(t, err) {
+		assert.Contains(t, config.NextProtos, acme.ALPNProto, "tls-alpn-01 challenge is not enabled")
+	}
+}
+
+// TestACMEIssuance obtains a certificate from a local ACME test server such
+// as pebble. It runs only when ACME_TEST_DIRECTORY is set, e.g.
+//
+//	ACME_TEST_DIRECTORY=https://localhost:14000/dir ACME_TEST_CA=pebble.minica.pem \
+//	ACME_TEST_HOST=app.example.com go test ./entrypoint -run TestACMEIssuance
+//
+// pebble must resolve ACME_TEST_HOST to this machine and validate on its
+// default ports, 5001 for tls-alpn-01 and 5002 for http-01.
+func TestACMEIssuance(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		t.Skip("ACME_TEST_DIRECTORY is not set")
+	}
+	host := os.Getenv("ACME_TEST_HOST")
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+
+	s, err := New(&EntryPoint{
+		Protocol: "https",
+		Addr:     ":5001",
+		TLS: &TLS{
+			ACME: &ACME{
+				DirectoryURL:      directory,
+				CAFile:            os.Getenv("ACME_TEST_CA"),
+				CacheDir:          dir,
+				HTTPChallengeAddr: ":5002",
+			},
+		},
+	}, nil)
+	if !assert.NoError(t, err, "error in instantiating https server") {
+		return
+	}
+	s.(CertificateHosts).SetCertificateHosts([]string{host})
+	go s.Start()
+	defer s.Close()
+	waitForServer("localhost:5001")
+
+	// the first handshake waits for the whole issuance
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", "localhost:5001", &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+	})
+	if assert.NoError(t, err, "error in tls handshake") {
+		defer conn.Close()
+		cert := conn.ConnectionState().PeerCertificates[0]
+		assert.Equal(t, []string{host}, cert.DNSNames)
+		assert.NotEqual(t, cert.Subject.String(), cert.Issuer.String(), "certificate should be issued by the acme server")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.NotEmpty(t, files, "certificate is not persisted in the cache directory")
+}
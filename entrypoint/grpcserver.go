@@ -0,0 +1,245 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpc status codes used by the entrypoint,
+// see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// Grpc accepts grpc calls over HTTP/2, in clear text (h2c) or over tls when
+// the entrypoint has a tls config. Calls are handled like http requests
+// with the "grpc" protocol and a grpc://host/package.Service/Method url.
+type Grpc struct {
+	Http
+	certificates *certificateStore
+}
+
+func NewGrpc(config *EntryPoint, handle HandleFunc) (*Grpc, error) {
+	g := &Grpc{
+		Http: Http{
+			config: config,
+			handle: handle,
+		},
+	}
+	if config.TLS != nil {
+		certificates, err := newCertificateStore(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := newTLSConfig(config.TLS, certificates); err != nil {
+			return nil, err
+		}
+		g.certificates = certificates
+	}
+	return g, nil
+}
+
+func (g *Grpc) Start() error {
+	server := &http.Server{
+		Addr:     g.config.Addr,
+		ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.WarnLevel), "", 0),
+	}
+	if g.certificates == nil {
+		logrus.Infof("start listening on %s for grpc", g.config.Addr)
+		server.Handler = h2c.NewHandler(g, &http2.Server{})
+		if err := g.setServer(server); err != nil {
+			return err
+		}
+		return server.ListenAndServe()
+	}
+
+	logrus.Infof("start listening on %s for grpc with tls", g.config.Addr)
+	tlsConfig, err := newTLSConfig(g.config.TLS, g.certificates)
+	if err != nil {
+		return err
+	}
+	if g.certificates.acme != nil {
+		if err := g.certificates.acme.startHTTPChallenge(); err != nil {
+			return err
+		}
+	}
+	server.Handler = g
+	server.TLSConfig = tlsConfig
+	if err := g.setServer(server); err != nil {
+		return err
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+func (g *Grpc) Close() error {
+	if g.certificates != nil && g.certificates.acme != nil {
+		g.certificates.acme.close()
+	}
+	return g.Http.Close()
+}
+
+func (g *Grpc) EqualConfig(c *EntryPoint) bool {
+	return g.Http.EqualConfig(c) && reflect.DeepEqual(c.TLS, g.config.TLS)
+}
+
+// ReloadCertificates reads the certificate files again when the entrypoint
+// is served over tls.
+func (g *Grpc) ReloadCertificates() error {
+	if g.certificates == nil {
+		return nil
+	}
+	return g.certificates.load()
+}
+
+// SetCertificateHosts sets the hosts acme certificates are obtained for.
+func (g *Grpc) SetCertificateHosts(hosts []string) {
+	if g.certificates != nil && g.certificates.acme != nil {
+		g.certificates.acme.setHosts(hosts)
+	}
+}
+
+func (g *Grpc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("called grpc %s", r.URL.Path)
+	if r.ProtoMajor != 2 || !isGrpcContentType(r.Header.Get("Content-Type")) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte("grpc calls must be sent over http/2 with an application/grpc content type"))
+		return
+	}
+
+	request, err := FromGrpc(r)
+	if err != nil {
+		logrus.WithError(err).Warnf("rejecting grpc call from %s", r.RemoteAddr)
+		writeGrpcStatus(w, grpcInternal, err.Error())
+		return
+	}
+	defer request.CtxCancel()
+	response := g.handle(request)
+	if !isGrpcContentType(response.HttpHeaders.Get("Content-Type")) {
+		g.writeHttpError(w, response)
+		return
+	}
+	g.WriteToHttp(w, response)
+}
+
+// FromGrpc converts a grpc call to a request. The deadline the client sent
+// in the grpc-timeout header becomes the deadline of the request context.
+func FromGrpc(r *http.Request) (*Request, error) {
+	request, err := FromHttp(r)
+	if err != nil {
+		return nil, err
+	}
+	request.Protocol = "grpc"
+	request.URL = "grpc://" + r.Host + r.URL.Path
+
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		timeout, err := parseGrpcTimeout(value)
+		if err != nil {
+			request.CtxCancel()
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(request.Context, timeout)
+		parentCancel := request.CtxCancel
+		request.Context = ctx
+		request.CtxCancel = func() {
+			cancel()
+			parentCancel()
+		}
+	}
+	return request, nil
+}
+
+// parseGrpcTimeout parses a grpc-timeout header value, at most eight digits
+// followed by a unit, e.g. 100m for 100 milliseconds.
+func parseGrpcTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit %q", value)
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func isGrpcContentType(contentType string) bool {
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// writeHttpError turns a response which is not a grpc response, e.g. an
+// error of the gateway itself, into a grpc status the client understands.
+func (g *Grpc) writeHttpError(w http.ResponseWriter, response *Response) {
+	var message string
+	if response.Body != nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		message = string(body)
+	}
+	if message == "" {
+		message = http.StatusText(response.HttpStatus)
+	}
+	writeGrpcStatus(w, grpcStatusFromHttp(response.HttpStatus), message)
+}
+
+// grpcStatusFromHttp maps http statuses to grpc status codes as grpc clients
+// do for responses which carry no grpc status,
+// see https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcStatusFromHttp(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeGrpcStatus writes a trailers-only grpc response, which carries the
+// status in its headers and has no body.
+func writeGrpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
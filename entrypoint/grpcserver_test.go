@@ -0,0 +1,84 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const grpcHost = "127.0.0.1:9552"
+
+func TestGrpcServer(t *testing.T) {
+	channel := make(chan *Request, 1)
+	s, err := New(&EntryPoint{Protocol: "grpc", Enabled: &True, Addr: grpcHost}, func(request *Request) *Response {
+		channel <- request
+		return &Response{
+			Body:       ioutil.NopCloser(bytes.NewBufferString("frontend does not match request")),
+			HttpStatus: http.StatusNotFound,
+		}
+	})
+	if !assert.NoError(t, err, "error in instantiating grpc server") {
+		return
+	}
+	go s.Start()
+	defer s.Close()
+	waitForServer(grpcHost)
+
+	conn, err := grpc.NewClient(grpcHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err, "error in dialing grpc server") {
+		return
+	}
+	defer conn.Close()
+
+	t.Run("TestHttpErrorToStatus", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+		assert.Equal(t, "frontend does not match request", status.Convert(err).Message())
+
+		request := <-channel
+		assert.Equal(t, "grpc", request.Protocol)
+		assert.Equal(t, "grpc://"+grpcHost+"/grpc.health.v1.Health/Check", request.URL)
+		deadline, ok := request.Context.Deadline()
+		if assert.True(t, ok, "grpc-timeout is not applied to the request") {
+			assert.WithinDuration(t, time.Now().Add(3*time.Second), deadline, time.Second)
+		}
+	})
+
+	t.Run("TestNotGrpc", func(t *testing.T) {
+		r, err := http.Post("http://"+grpcHost+"/grpc.health.v1.Health/Check", "application/json", nil)
+		if assert.NoError(t, err) {
+			r.Body.Close()
+			assert.Equal(t, http.StatusUnsupportedMediaType, r.StatusCode)
+		}
+	})
+}
+
+func TestParseGrpcTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"100m":      100 * time.Millisecond,
+		"5S":        5 * time.Second,
+		"1H":        time.Hour,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		timeout, err := parseGrpcTimeout(value)
+		if assert.NoError(t, err, "error in parsing %s", value) {
+			assert.Equal(t, expected, timeout)
+		}
+	}
+	for _, value := range []string{"", "m", "100", "100x", "123456789S", "-1S"} {
+		_, err := parseGrpcTimeout(value)
+		assert.Error(t, err, "%q should be rejected", value)
+	}
+}
@@ -10,79 +10,193 @@ import (
 	"time"
 	"io"
 	"sync"
+	"strings"
 )
 
 type Http struct {
 	config  *EntryPoint
-	server  *http.Server
 	handle  HandleFunc
 
+	// mtx guards server, which is set by Start and closed by Close from
+	// other goroutines.
+	mtx    sync.Mutex
+	server *http.Server
+	closed bool
+
 	FlushInterval time.Duration
 	BufferPool    httputil.BufferPool
 }
 
 func (h *Http) Start() error {
 	logrus.Infof("start listening on %s", h.config.Addr)
-	h.server = &http.Server{Addr: h.config.Addr, Handler: h}
-	return h.server.ListenAndServe()
+	server := &http.Server{Addr: h.config.Addr, Handler: h}
+	if err := h.setServer(server); err != nil {
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+// setServer sets the server Start is about to serve, unless the entrypoint
+// is closed already.
+func (h *Http) setServer(server *http.Server) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.closed {
+		return http.ErrServerClosed
+	}
+	h.server = server
+	return nil
 }
 
+// Close stops the server, an entrypoint which was not started is only
+// marked as closed.
 func (h *Http) Close() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.closed = true
+	if h.server == nil {
+		return nil
+	}
 	return h.server.Close()
 }
 
 func (h *Http) EqualConfig(c *EntryPoint) bool {
 	return c.Protocol == h.config.Protocol &&
-		c.Enabled == h.config.Enabled &&
-		c.Addr == h.config.Addr
+		isEnabled(c) == isEnabled(h.config) &&
+		c.Addr == h.config.Addr &&
+		c.IdleTimeout == h.config.IdleTimeout
+}
+
+func isEnabled(c *EntryPoint) bool {
+	return c.Enabled == nil || *c.Enabled
 }
 
 func (h *Http) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logrus.Debugf("called [%s] /%s", r.Method, r.URL.Path[1:])
 	requestRequest, err := FromHttp(r)
 	if err != nil {
+		logrus.WithError(err).Warnf("rejecting request from %s", r.RemoteAddr)
 		badRequest(w)
 		return
 	}
+	defer requestRequest.CtxCancel()
 	response := h.handle(requestRequest)
 	logrus.Debugf("start writing response")
 	h.WriteToHttp(w, response)
 }
 
 func FromHttp(r *http.Request) (*Request, error) {
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	// The context lives as long as the client connection, so a streamed
+	// response is not cut off halfway. Backends apply their own timeouts.
+	ctx, cancel := context.WithCancel(r.Context())
+	protocol := "http"
+	if r.TLS != nil {
+		protocol = "https"
+	}
 	obj := Request{
-		Protocol:    "http",
-		Context:     ctx,
-		CtxCancel:   cancel,
-		ClientIP:    r.RemoteAddr,
-		HttpHeaders: r.Header,
-		HttpMethod:  r.Method,
-		URL:         "http://" + r.Host + r.RequestURI,
-		Body:        r.Body,
+		Protocol:     protocol,
+		Context:      ctx,
+		CtxCancel:    cancel,
+		ClientIP:     r.RemoteAddr,
+		HttpHeaders:  r.Header,
+		HttpTrailers: r.Trailer,
+		HttpMethod:   r.Method,
+		URL:          protocol + "://" + r.Host + r.RequestURI,
+		Body:         r.Body,
 	}
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		obj.ClientIP = clientIP
 	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		obj.ClientIdentity = newClientIdentity(r.TLS.PeerCertificates[0])
+	}
 	return &obj, nil
 }
 
 func (h *Http) WriteToHttp(w http.ResponseWriter, response *Response) {
+	if response.Body != nil {
+		defer response.Body.Close()
+	}
+	if response.HttpStatus == http.StatusSwitchingProtocols {
+		h.serveUpgrade(w, response)
+		return
+	}
 	copyHeader(w.Header(), response.HttpHeaders)
-	h.copyResponse(w, response.Body)
+
+	announced := make([]string, 0, len(response.HttpTrailers))
+	for k := range response.HttpTrailers {
+		announced = append(announced, k)
+	}
+	if len(announced) > 0 {
+		w.Header().Set("Trailer", strings.Join(announced, ", "))
+	}
+
 	w.WriteHeader(response.HttpStatus)
+	if len(announced) > 0 {
+		// Force chunking if we saw a response trailer.
+		// This prevents net/http from calculating the length for short
+		// bodies and adding a Content-Length.
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+
+	if response.Body != nil {
+		if _, err := h.copyResponse(w, response.Body, h.flushInterval(response)); err != nil && err != io.EOF {
+			logrus.WithError(err).Debug("response body copy is interrupted")
+			return
+		}
+	}
+
+	writeTrailers(w.Header(), response.HttpTrailers, announced)
 }
 
-func (h *Http) copyResponse(dst io.Writer, src io.ReadCloser) {
-	if h.FlushInterval != 0 {
+// writeTrailers sets the trailer values on the header map of a response
+// whose body is already written. Trailers which were not announced before
+// the body are sent with the http.TrailerPrefix.
+func writeTrailers(dst http.Header, trailers http.Header, announced []string) {
+	if len(trailers) == 0 {
+		return
+	}
+	isAnnounced := make(map[string]bool, len(announced))
+	for _, k := range announced {
+		isAnnounced[k] = true
+	}
+	for k, vv := range trailers {
+		if !isAnnounced[k] {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// flushInterval returns how often the response should be flushed to the
+// client. Event streams and bodies of unknown length are flushed after
+// every write so long-polls are not held back in the buffer.
+func (h *Http) flushInterval(response *Response) time.Duration {
+	if response.HttpHeaders.Get("Content-Type") == "text/event-stream" {
+		return -1
+	}
+	if response.HttpHeaders.Get("Content-Length") == "" {
+		return -1
+	}
+	return h.FlushInterval
+}
+
+func (h *Http) copyResponse(dst io.Writer, src io.Reader, flushInterval time.Duration) (int64, error) {
+	if flushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
 			mlw := &maxLatencyWriter{
 				dst:     wf,
-				latency: h.FlushInterval,
+				latency: flushInterval,
 				done:    make(chan bool),
 			}
-			go mlw.flushLoop()
-			defer mlw.stop()
+			if flushInterval > 0 {
+				go mlw.flushLoop()
+				defer mlw.stop()
+			}
 			dst = mlw
 		}
 	}
@@ -90,19 +204,19 @@ func (h *Http) copyResponse(dst io.Writer, src io.ReadCloser) {
 	var buf []byte
 	if h.BufferPool != nil {
 		buf = h.BufferPool.Get()
+		defer h.BufferPool.Put(buf)
 	}
-	h.copyBuffer(dst, src, buf)
-	if h.BufferPool != nil {
-		h.BufferPool.Put(buf)
-	}
+	return h.copyBuffer(dst, src, buf)
 }
 
-func (h *Http) copyBuffer(dst io.Writer, src io.ReadCloser, buf []byte) (int64, error) {
+// copyBuffer copies src to dst until either EOF is reached on src or an error
+// occurs. Each chunk is written before the next one is read, so a slow client
+// slows down reading from the backend instead of piling up in memory.
+func (h *Http) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
 	if len(buf) == 0 {
 		buf = make([]byte, 32*1024)
 	}
 	var written int64
-	//defer src.Close()
 	for {
 		nr, rerr := src.Read(buf)
 		if rerr != nil && rerr != io.EOF && rerr != context.Canceled {
@@ -127,6 +241,7 @@ func (h *Http) copyBuffer(dst io.Writer, src io.ReadCloser, buf []byte) (int64,
 }
 
 func badRequest(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
 	w.Write([]byte("bad request"))
 }
 
@@ -141,7 +256,11 @@ type maxLatencyWriter struct {
 func (m *maxLatencyWriter) Write(p []byte) (int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.dst.Write(p)
+	n, err := m.dst.Write(p)
+	if m.latency < 0 {
+		m.dst.Flush()
+	}
+	return n, err
 }
 
 var onExitFlushLoop func()
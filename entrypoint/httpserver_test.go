@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"time"
+	"io"
+	"net/http/httptest"
 )
 
 const host = "localhost:9090"
@@ -68,3 +70,158 @@ func TestHttpServer(t *testing.T) {
 		}
 	})
 }
+
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHttpServerStreamsResponse(t *testing.T) {
+	bodyReader, bodyWriter := io.Pipe()
+	body := &closeRecorder{Reader: bodyReader, closed: make(chan struct{})}
+	h := &Http{
+		handle: func(request *Request) *Response {
+			return &Response{
+				Protocol:    "http",
+				Body:        body,
+				HttpStatus:  200,
+				HttpHeaders: http.Header{},
+			}
+		},
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	go bodyWriter.Write([]byte("first"))
+	r, err := http.Get(server.URL)
+	if !assert.NoError(t, err, "error while sending http request to server") {
+		return
+	}
+	defer r.Body.Close()
+	assert.Equal(t, 200, r.StatusCode)
+
+	// the first chunk arrives while the body is still open
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(r.Body, first)
+	if assert.NoError(t, err, "error in reading first chunk") {
+		assert.Equal(t, "first", string(first))
+	}
+
+	go func() {
+		bodyWriter.Write([]byte("second"))
+		bodyWriter.Close()
+	}()
+	rest, err := ioutil.ReadAll(r.Body)
+	if assert.NoError(t, err, "error in reading rest of body") {
+		assert.Equal(t, "second", string(rest))
+	}
+
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Error("response body is not closed after writing")
+	}
+}
+
+func TestHttpServerClosesBodyOnClientDisconnect(t *testing.T) {
+	bodyReader, bodyWriter := io.Pipe()
+	body := &closeRecorder{Reader: bodyReader, closed: make(chan struct{})}
+	h := &Http{
+		handle: func(request *Request) *Response {
+			go func() {
+				<-request.Context.Done()
+				bodyWriter.CloseWithError(request.Context.Err())
+			}()
+			return &Response{
+				Protocol:    "http",
+				Body:        body,
+				HttpStatus:  200,
+				HttpHeaders: http.Header{},
+			}
+		},
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	go bodyWriter.Write([]byte("first"))
+	r, err := http.Get(server.URL)
+	if !assert.NoError(t, err, "error while sending http request to server") {
+		return
+	}
+	first := make([]byte, len("first"))
+	io.ReadFull(r.Body, first)
+	r.Body.Close()
+
+	select {
+	case <-body.closed:
+	case <-time.After(2 * time.Second):
+		t.Error("response body is not closed after client disconnect")
+	}
+}
+
+// trailerBody fills its trailers once it is read to the end, like the body
+// of an upstream response does.
+type trailerBody struct {
+	io.Reader
+	response *Response
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.response.HttpTrailers.Set("X-Checksum", "abc")
+		b.response.HttpTrailers.Set("X-Unannounced", "xyz")
+	}
+	return n, err
+}
+
+func (b *trailerBody) Close() error {
+	return nil
+}
+
+func TestHttpServerTrailers(t *testing.T) {
+	h := &Http{
+		handle: func(request *Request) *Response {
+			response := &Response{
+				Protocol:     "http",
+				HttpStatus:   200,
+				HttpHeaders:  http.Header{},
+				HttpTrailers: http.Header{"X-Checksum": nil},
+			}
+			response.Body = &trailerBody{Reader: bytes.NewBufferString("hi"), response: response}
+			return response
+		},
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	r, err := http.Get(server.URL)
+	if !assert.NoError(t, err, "error while sending http request to server") {
+		return
+	}
+	defer r.Body.Close()
+
+	_, announced := r.Trailer["X-Checksum"]
+	assert.True(t, announced, "trailer is not announced")
+	body, err := ioutil.ReadAll(r.Body)
+	if assert.NoError(t, err, "error in reading body") {
+		assert.Equal(t, "hi", string(body))
+	}
+	assert.Equal(t, "abc", r.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "xyz", r.Trailer.Get("X-Unannounced"))
+}
+
+func TestHttpServerClose(t *testing.T) {
+	s, err := New(&EntryPoint{Protocol: "http", Addr: "127.0.0.1:0"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// entrypoints built to validate their config are closed unstarted
+	assert.NoError(t, s.Close())
+	assert.Equal(t, http.ErrServerClosed, s.Start())
+}
@@ -0,0 +1,85 @@
+package entrypoint
+
+import (
+	"errors"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"log"
+	"net/http"
+	"reflect"
+)
+
+type Https struct {
+	Http
+	certificates *certificateStore
+}
+
+func NewHttps(config *EntryPoint, handle HandleFunc) (*Https, error) {
+	if config.TLS == nil {
+		return nil, errors.New("tls is not set for https server")
+	}
+	certificates, err := newCertificateStore(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	// validate the tls config before the server is started
+	if _, err := newTLSConfig(config.TLS, certificates); err != nil {
+		return nil, err
+	}
+	return &Https{
+		Http: Http{
+			config: config,
+			handle: handle,
+		},
+		certificates: certificates,
+	}, nil
+}
+
+func (h *Https) Start() error {
+	logrus.Infof("start listening on %s with tls", h.config.Addr)
+	tlsConfig, err := newTLSConfig(h.config.TLS, h.certificates)
+	if err != nil {
+		return err
+	}
+	if h.certificates.acme != nil {
+		if err := h.certificates.acme.startHTTPChallenge(); err != nil {
+			return err
+		}
+	}
+	server := &http.Server{
+		Addr:      h.config.Addr,
+		Handler:   h,
+		TLSConfig: tlsConfig,
+		// failed handshakes, e.g. rejected client certificates, are
+		// reported through the error log of the server
+		ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.WarnLevel), "", 0),
+	}
+	if err := h.setServer(server); err != nil {
+		return err
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+func (h *Https) Close() error {
+	if h.certificates.acme != nil {
+		h.certificates.acme.close()
+	}
+	return h.Http.Close()
+}
+
+func (h *Https) EqualConfig(c *EntryPoint) bool {
+	return h.Http.EqualConfig(c) && reflect.DeepEqual(c.TLS, h.config.TLS)
+}
+
+// ReloadCertificates reads the certificate files again. New handshakes use
+// the new certificates, open connections are not affected.
+func (h *Https) ReloadCertificates() error {
+	return h.certificates.load()
+}
+
+// SetCertificateHosts sets the hosts acme certificates are obtained for.
+func (h *Https) SetCertificateHosts(hosts []string) {
+	if h.certificates.acme != nil {
+		h.certificates.acme.setHosts(hosts)
+	}
+}
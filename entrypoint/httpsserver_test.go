@@ -0,0 +1,203 @@
+package entrypoint
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const tlsHost = "localhost:9443"
+
+// writeCertificate writes a self-signed certificate for names to dir and
+// returns the paths of the certificate and key files.
+func writeCertificate(t *testing.T, dir, file string, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, file+".crt")
+	keyFile := filepath.Join(dir, file+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func peerCertificate(t *testing.T, serverName string, maxVersion uint16) (*x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", tlsHost, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func waitForServer(addr string) {
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	defaultCert, defaultKey := writeCertificate(t, dir, "default", "default.example.com")
+	appCert, appKey := writeCertificate(t, dir, "app", "app.example.com")
+	wildcardCert, wildcardKey := writeCertificate(t, dir, "wildcard", "*.wild.example.com")
+
+	store, err := newCertificateStore(&TLS{
+		CertFile: defaultCert,
+		KeyFile:  defaultKey,
+		Certificates: []Certificate{
+			{CertFile: appCert, KeyFile: appKey},
+			{CertFile: wildcardCert, KeyFile: wildcardKey},
+		},
+	})
+	if !assert.NoError(t, err, "error in loading certificates") {
+		return
+	}
+
+	for serverName, expected := range map[string]string{
+		"app.example.com":      "app.example.com",
+		"APP.example.com.":     "app.example.com",
+		"a.wild.example.com":   "*.wild.example.com",
+		"a.b.wild.example.com": "default.example.com",
+		"unknown.example.com":  "default.example.com",
+		"":                     "default.example.com",
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, cert.Leaf.DNSNames[0], "wrong certificate for %q", serverName)
+		}
+	}
+
+	_, err = newCertificateStore(&TLS{})
+	assert.Error(t, err, "https without certificates should be rejected")
+}
+
+func TestHttpsServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	appCert, appKey := writeCertificate(t, dir, "app", "app.example.com")
+	otherCert, otherKey := writeCertificate(t, dir, "other", "other.example.com")
+
+	config := &EntryPoint{
+		Protocol: "https",
+		Enabled:  &True,
+		Addr:     tlsHost,
+		TLS: &TLS{
+			Certificates: []Certificate{
+				{CertFile: appCert, KeyFile: appKey},
+				{CertFile: otherCert, KeyFile: otherKey},
+			},
+			MinVersion: "1.2",
+		},
+	}
+	channel := make(chan *Request, 1)
+	s, err := New(config, func(request *Request) *Response {
+		channel <- request
+		return &Response{
+			Protocol:    "http",
+			Body:        ioutil.NopCloser(bytes.NewBufferString("hi")),
+			HttpStatus:  200,
+			HttpHeaders: http.Header{},
+		}
+	})
+	if !assert.NoError(t, err, "error in instantiating https server") {
+		return
+	}
+	go s.Start()
+	defer s.Close()
+	waitForServer(tlsHost)
+
+	t.Run("TestSNI", func(t *testing.T) {
+		cert, err := peerCertificate(t, "other.example.com", 0)
+		if assert.NoError(t, err, "error in tls handshake") {
+			assert.Equal(t, "other.example.com", cert.Subject.CommonName)
+		}
+	})
+
+	t.Run("TestMinVersion", func(t *testing.T) {
+		_, err := peerCertificate(t, "app.example.com", tls.VersionTLS11)
+		assert.Error(t, err, "handshake below min version should fail")
+	})
+
+	t.Run("TestRequestIsHttps", func(t *testing.T) {
+		client := http.Client{
+			Timeout:   2 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		r, err := client.Get("https://" + tlsHost + "/path")
+		if assert.NoError(t, err, "error while sending https request to server") {
+			r.Body.Close()
+			request := <-channel
+			assert.Equal(t, "https", request.Protocol)
+			assert.Equal(t, "https://"+tlsHost+"/path", request.URL)
+		}
+	})
+
+	t.Run("TestReloadCertificates", func(t *testing.T) {
+		before, err := peerCertificate(t, "app.example.com", 0)
+		if !assert.NoError(t, err, "error in tls handshake") {
+			return
+		}
+		writeCertificate(t, dir, "app", "app.example.com")
+		if assert.NoError(t, s.(CertificateReloader).ReloadCertificates(), "error in reloading certificates") {
+			after, err := peerCertificate(t, "app.example.com", 0)
+			if assert.NoError(t, err, "error in tls handshake") {
+				assert.NotEqual(t, before.SerialNumber, after.SerialNumber, "certificate is not reloaded")
+			}
+		}
+	})
+
+	t.Run("TestEqualConfig", func(t *testing.T) {
+		changed := *config
+		changed.TLS = &TLS{Certificates: config.TLS.Certificates, MinVersion: "1.3"}
+		assert.False(t, s.EqualConfig(&changed), "tls config change should restart the server")
+
+		same := *config
+		same.TLS = &TLS{Certificates: config.TLS.Certificates, MinVersion: "1.2"}
+		assert.True(t, s.EqualConfig(&same))
+	})
+}
@@ -0,0 +1,31 @@
+package entrypoint
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics serves the counters of the gateway, e.g. the hedged requests of
+// each backend, as json on /debug/vars. It routes no requests to frontends.
+type Metrics struct {
+	Http
+}
+
+func (m *Metrics) Start() error {
+	logrus.Infof("start listening on %s for metrics", m.config.Addr)
+	server := &http.Server{Addr: m.config.Addr, Handler: m}
+	if err := m.setServer(server); err != nil {
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/debug/vars" {
+		http.NotFound(w, r)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,34 @@
+package entrypoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsServer(t *testing.T) {
+	s, err := New(&EntryPoint{Protocol: "metrics", Enabled: &True}, nil)
+	if !assert.NoError(t, err, "error in instantiating metrics server") {
+		return
+	}
+	server := httptest.NewServer(s.(http.Handler))
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/debug/vars")
+	if assert.NoError(t, err) {
+		var vars map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&vars))
+		r.Body.Close()
+		assert.Contains(t, vars, "memstats")
+	}
+
+	r, err = http.Get(server.URL + "/users")
+	if assert.NoError(t, err) {
+		r.Body.Close()
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	}
+}
@@ -11,6 +11,18 @@ type Server interface {
 	EqualConfig(c *EntryPoint) bool
 }
 
+// CertificateReloader is implemented by servers which can pick up changed
+// certificate files without being restarted.
+type CertificateReloader interface {
+	ReloadCertificates() error
+}
+
+// CertificateHosts is implemented by servers which obtain certificates on
+// demand. Only hosts routed by a frontend get a certificate.
+type CertificateHosts interface {
+	SetCertificateHosts(hosts []string)
+}
+
 func New(config *EntryPoint, handle HandleFunc) (Server, error) {
 	switch config.Protocol {
 	case "http":
@@ -22,6 +34,39 @@ func New(config *EntryPoint, handle HandleFunc) (Server, error) {
 			handle:  handle,
 		}, nil
 
+	case "https":
+		if config.Enabled != nil && !*config.Enabled {
+			return nil, fmt.Errorf("%s server is not enabled in config", config.Protocol)
+		}
+		return NewHttps(config, handle)
+
+	case "grpc":
+		if config.Enabled != nil && !*config.Enabled {
+			return nil, fmt.Errorf("%s server is not enabled in config", config.Protocol)
+		}
+		return NewGrpc(config, handle)
+
+	case "websocket":
+		if config.Enabled != nil && !*config.Enabled {
+			return nil, fmt.Errorf("%s server is not enabled in config", config.Protocol)
+		}
+		return &Websocket{
+			Http: Http{
+				config: config,
+				handle: handle,
+			},
+		}, nil
+
+	case "metrics":
+		if config.Enabled != nil && !*config.Enabled {
+			return nil, fmt.Errorf("%s server is not enabled in config", config.Protocol)
+		}
+		return &Metrics{
+			Http: Http{
+				config: config,
+			},
+		}, nil
+
 	default:
 		return nil, fmt.Errorf("protocol %s for frontend is not supported", config.Protocol)
 	}
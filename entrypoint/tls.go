@@ -0,0 +1,312 @@
+package entrypoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certificateStore holds the certificates of a TLS entrypoint and picks one
+// for each handshake by the server name the client asked for (SNI).
+type certificateStore struct {
+	config *TLS
+	acme   *acmeManager
+
+	mtx       sync.RWMutex
+	byName    map[string]*tls.Certificate
+	fallback  *tls.Certificate
+	clientCAs *x509.CertPool
+	revoked   map[string]bool
+}
+
+func newCertificateStore(config *TLS) (*certificateStore, error) {
+	s := &certificateStore{config: config}
+	if config.ACME != nil {
+		var err error
+		if s.acme, err = newACMEManager(config.ACME); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// certificateFiles returns every certificate/key pair of config, the single
+// certFile/keyFile pair coming first so it is used when SNI does not match.
+func certificateFiles(config *TLS) []Certificate {
+	var files []Certificate
+	if config.CertFile != "" || config.KeyFile != "" {
+		files = append(files, Certificate{CertFile: config.CertFile, KeyFile: config.KeyFile})
+	}
+	return append(files, config.Certificates...)
+}
+
+// load reads all certificate files again. The current certificates are kept
+// if any of the files is invalid.
+func (s *certificateStore) load() error {
+	files := certificateFiles(s.config)
+	if len(files) == 0 && s.acme == nil {
+		return errors.New("no certificate is set")
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for _, file := range files {
+		cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load certificate %s. error=%v", file.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate %s. error=%v", file.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		if fallback == nil {
+			fallback = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, exists := byName[name]; !exists {
+				byName[name] = &cert
+			}
+		}
+	}
+
+	var clientCAs *x509.CertPool
+	var revoked map[string]bool
+	if s.config.ClientAuth != nil {
+		var err error
+		clientCAs, revoked, err = loadClientAuth(s.config.ClientAuth)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.byName = byName
+	s.fallback = fallback
+	s.clientCAs = clientCAs
+	s.revoked = revoked
+	return nil
+}
+
+// loadClientAuth reads the CA bundle and the optional CRL used to verify
+// client certificates. Revoked certificates are keyed by revocationKey.
+func loadClientAuth(config *ClientAuth) (*x509.CertPool, map[string]bool, error) {
+	if config.CAFile == "" {
+		return nil, nil, errors.New("caFile is not set for client auth")
+	}
+	caPem, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read client ca file %s. error=%v", config.CAFile, err)
+	}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(caPem); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse client ca file %s. error=%v", config.CAFile, err)
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found in client ca file %s", config.CAFile)
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+
+	revoked := make(map[string]bool)
+	if config.CRLFile == "" {
+		return pool, revoked, nil
+	}
+	crlData, err := ioutil.ReadFile(config.CRLFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read crl file %s. error=%v", config.CRLFile, err)
+	}
+	if block, _ := pem.Decode(crlData); block != nil {
+		crlData = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse crl file %s. error=%v", config.CRLFile, err)
+	}
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, nil, fmt.Errorf("crl file %s is not signed by any client ca", config.CRLFile)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[revocationKey(crl.RawIssuer, entry.SerialNumber.String())] = true
+	}
+	return pool, revoked, nil
+}
+
+func revocationKey(issuer []byte, serial string) string {
+	return string(issuer) + "/" + serial
+}
+
+// verifyClientCertificate verifies the certificate chain a client sent
+// against the client CAs. It runs for every connection, resumed sessions
+// included, so reloaded CAs and CRLs apply without restarting the server.
+func (s *certificateStore) verifyClientCertificate(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		if s.config.ClientAuth.Optional {
+			return nil
+		}
+		return errors.New("client certificate is required")
+	}
+
+	s.mtx.RLock()
+	clientCAs, revoked := s.clientCAs, s.revoked
+	s.mtx.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate %q is rejected. error=%v", certs[0].Subject.String(), err)
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())] {
+				return fmt.Errorf("client certificate %q is revoked", cert.Subject.String())
+			}
+		}
+	}
+	return nil
+}
+
+func newClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	identity := &ClientIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil && isChallenge(hello) {
+		return s.acme.GetCertificate(hello)
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert := s.lookup(name); cert != nil {
+		return cert, nil
+	}
+	if s.acme != nil && s.acme.allows(name) {
+		return s.acme.GetCertificate(hello)
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.fallback == nil {
+		return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+	}
+	return s.fallback, nil
+}
+
+func (s *certificateStore) lookup(name string) *tls.Certificate {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	// a.example.com is served by a *.example.com certificate
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if cert, ok := s.byName["*"+name[dot:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+func newTLSConfig(config *TLS, certificates *certificateStore) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.ACME != nil {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(config.MinVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls min version %s", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.ClientAuth != nil {
+		// Chains are verified by the certificate store instead of the tls
+		// package, so the CAs and the CRL can be reloaded like certificates.
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		if config.ClientAuth.Optional {
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+		// VerifyConnection, unlike VerifyPeerCertificate, also runs when a
+		// session is resumed, so revoked certificates do not live on in
+		// session tickets.
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return certificates.verifyClientCertificate(state.PeerCertificates)
+		}
+	}
+
+	if len(config.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range config.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("cipher suite %s is not supported", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return tlsConfig, nil
+}
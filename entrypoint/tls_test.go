@@ -0,0 +1,235 @@
+package entrypoint
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const mtlsHost = "localhost:9445"
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) (*testCA, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "partners ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	return &testCA{cert: cert, key: key}, caFile
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, name string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"partner"}},
+		DNSNames:     []string{name + ".partner.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeCRL(t *testing.T, dir string, serials ...int64) string {
+	var revoked []x509.RevocationListEntry
+	for _, serial := range serials {
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600)
+	return crlFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "server", "api.example.com")
+	ca, caFile := newTestCA(t, dir)
+	crlFile := ca.writeCRL(t, dir, 3)
+	valid := ca.issue(t, 2, "acme")
+	revoked := ca.issue(t, 3, "evil")
+	os.Mkdir(filepath.Join(dir, "other"), 0700)
+	otherCA, _ := newTestCA(t, filepath.Join(dir, "other"))
+	untrusted := otherCA.issue(t, 2, "acme")
+
+	config := &EntryPoint{
+		Protocol: "https",
+		Enabled:  &True,
+		Addr:     mtlsHost,
+		TLS: &TLS{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			ClientAuth: &ClientAuth{
+				CAFile:  caFile,
+				CRLFile: crlFile,
+			},
+		},
+	}
+	channel := make(chan *Request, 1)
+	s, err := New(config, func(request *Request) *Response {
+		channel <- request
+		return &Response{
+			Protocol:    "http",
+			Body:        ioutil.NopCloser(bytes.NewBufferString("hi")),
+			HttpStatus:  200,
+			HttpHeaders: http.Header{},
+		}
+	})
+	if !assert.NoError(t, err, "error in instantiating https server") {
+		return
+	}
+	go s.Start()
+	defer s.Close()
+	waitForServer(mtlsHost)
+
+	get := func(certificates ...tls.Certificate) (*http.Response, error) {
+		client := http.Client{
+			Timeout: 2 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       certificates,
+			}},
+		}
+		return client.Get("https://" + mtlsHost + "/")
+	}
+
+	t.Run("TestValidCertificate", func(t *testing.T) {
+		r, err := get(valid)
+		if assert.NoError(t, err, "valid client certificate is rejected") {
+			r.Body.Close()
+			request := <-channel
+			if assert.NotNil(t, request.ClientIdentity) {
+				assert.Equal(t, "acme", request.ClientIdentity.CommonName)
+				assert.Equal(t, []string{"acme.partner.example.com"}, request.ClientIdentity.DNSNames)
+				assert.Equal(t, "CN=acme,O=partner", request.ClientIdentity.Subject)
+			}
+		}
+	})
+
+	t.Run("TestNoCertificate", func(t *testing.T) {
+		_, err := get()
+		assert.Error(t, err, "request without client certificate should be rejected")
+	})
+
+	t.Run("TestUntrustedCertificate", func(t *testing.T) {
+		_, err := get(untrusted)
+		assert.Error(t, err, "client certificate of another ca should be rejected")
+	})
+
+	t.Run("TestRevokedCertificate", func(t *testing.T) {
+		_, err := get(revoked)
+		assert.Error(t, err, "revoked client certificate should be rejected")
+	})
+
+	t.Run("TestRevokedAfterResumption", func(t *testing.T) {
+		resumed := ca.issue(t, 4, "resumed")
+		client := http.Client{
+			Timeout: 2 * time.Second,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{resumed},
+					ClientSessionCache: tls.NewLRUClientSessionCache(1),
+				},
+			},
+		}
+		for i := 0; i < 2; i++ {
+			r, err := client.Get("https://" + mtlsHost + "/")
+			if !assert.NoError(t, err) {
+				return
+			}
+			r.Body.Close()
+			<-channel
+			assert.Equal(t, i > 0, r.TLS.DidResume)
+		}
+
+		ca.writeCRL(t, dir, 3, 4)
+		if assert.NoError(t, s.(CertificateReloader).ReloadCertificates()) {
+			_, err := client.Get("https://" + mtlsHost + "/")
+			assert.Error(t, err, "revoked certificate is accepted in a resumed session")
+		}
+		ca.writeCRL(t, dir, 3)
+		assert.NoError(t, s.(CertificateReloader).ReloadCertificates())
+	})
+
+	t.Run("TestReloadCRL", func(t *testing.T) {
+		ca.writeCRL(t, dir, 2, 3)
+		if assert.NoError(t, s.(CertificateReloader).ReloadCertificates()) {
+			_, err := get(valid)
+			assert.Error(t, err, "certificate revoked by the reloaded crl should be rejected")
+		}
+	})
+}
+
+func TestOptionalClientAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apigateway")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "server", "api.example.com")
+	ca, caFile := newTestCA(t, dir)
+
+	store, err := newCertificateStore(&TLS{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ClientAuth: &ClientAuth{CAFile: caFile, Optional: true},
+	})
+	if !assert.NoError(t, err, "error in loading certificates") {
+		return
+	}
+	assert.NoError(t, store.verifyClientCertificate(nil), "client certificate is optional")
+	valid := ca.issue(t, 2, "acme")
+	leaf, _ := x509.ParseCertificate(valid.Certificate[0])
+	assert.NoError(t, store.verifyClientCertificate([]*x509.Certificate{leaf}))
+
+	_, err = newCertificateStore(&TLS{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ClientAuth: &ClientAuth{CAFile: certFile, CRLFile: ca.writeCRL(t, dir, 2)},
+	})
+	assert.Error(t, err, "crl signed by an unknown ca should be rejected")
+}
@@ -0,0 +1,115 @@
+package entrypoint
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultIdleTimeout = 5 * time.Minute
+
+// serveUpgrade takes over the client connection of a request the backend
+// switched protocols for, e.g. a websocket, and pipes it to the backend
+// connection, the body of response, until either side closes it.
+func (h *Http) serveUpgrade(w http.ResponseWriter, response *Response) {
+	backend, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		logrus.Error("upgraded response has no backend connection")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logrus.Error("can not switch protocols of a connection which can not be hijacked")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		logrus.WithError(err).Error("unable to hijack client connection")
+		return
+	}
+	defer conn.Close()
+
+	res := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     response.HttpHeaders,
+	}
+	if err := res.Write(brw); err != nil {
+		logrus.WithError(err).Debug("unable to write upgrade response")
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		logrus.WithError(err).Debug("unable to write upgrade response")
+		return
+	}
+
+	timeout := h.config.IdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleTimeout
+	}
+	idle := newIdleTimer(timeout, func() {
+		logrus.Debugf("closing idle upgraded connection of %s", conn.RemoteAddr())
+		conn.Close()
+		backend.Close()
+	})
+	defer idle.stop()
+
+	errc := make(chan error, 2)
+	go pipe(errc, &idleWriter{Writer: backend, idle: idle}, brw)
+	go pipe(errc, &idleWriter{Writer: conn, idle: idle}, backend)
+	if err := <-errc; err != nil && err != io.EOF {
+		logrus.WithError(err).Debug("upgraded connection is closed")
+	}
+}
+
+func pipe(errc chan<- error, dst io.Writer, src io.Reader) {
+	_, err := io.Copy(dst, src)
+	if err == nil {
+		err = io.EOF
+	}
+	errc <- err
+}
+
+// idleTimer calls its function once no data is written for timeout.
+type idleTimer struct {
+	mtx     sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	stopped bool
+}
+
+func newIdleTimer(timeout time.Duration, f func()) *idleTimer {
+	return &idleTimer{timer: time.AfterFunc(timeout, f), timeout: timeout}
+}
+
+func (t *idleTimer) reset() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.stopped {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// idleWriter resets the idle timer of an upgraded connection on every write.
+type idleWriter struct {
+	io.Writer
+	idle *idleTimer
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	w.idle.reset()
+	return w.Writer.Write(p)
+}
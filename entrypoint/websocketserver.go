@@ -0,0 +1,60 @@
+package entrypoint
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// Websocket accepts websocket handshakes only. Requests are handled with
+// the "websocket" protocol and a ws://host/path url, so they are routed by
+// websocket frontends; http entrypoints pass websockets through as well.
+type Websocket struct {
+	Http
+}
+
+func (ws *Websocket) Start() error {
+	logrus.Infof("start listening on %s for websockets", ws.config.Addr)
+	server := &http.Server{Addr: ws.config.Addr, Handler: ws}
+	if err := ws.setServer(server); err != nil {
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+func (ws *Websocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("called websocket %s", r.URL.Path)
+	if !isWebsocketHandshake(r) {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		w.Write([]byte("websocket handshake is expected"))
+		return
+	}
+
+	request, err := FromHttp(r)
+	if err != nil {
+		logrus.WithError(err).Warnf("rejecting websocket from %s", r.RemoteAddr)
+		badRequest(w)
+		return
+	}
+	defer request.CtxCancel()
+	request.Protocol = "websocket"
+	request.URL = "ws://" + r.Host + r.RequestURI
+	response := ws.handle(request)
+	ws.WriteToHttp(w, response)
+}
+
+func isWebsocketHandshake(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
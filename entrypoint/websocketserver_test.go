@@ -0,0 +1,45 @@
+package entrypoint
+
+import (
+	"bytes"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebsocketServer(t *testing.T) {
+	channel := make(chan *Request, 1)
+	s, err := New(&EntryPoint{Protocol: "websocket", Enabled: &True}, func(request *Request) *Response {
+		channel <- request
+		return &Response{
+			Body:       ioutil.NopCloser(bytes.NewBufferString("no frontend")),
+			HttpStatus: http.StatusNotFound,
+		}
+	})
+	if !assert.NoError(t, err, "error in instantiating websocket server") {
+		return
+	}
+	server := httptest.NewServer(s.(http.Handler))
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/chat")
+	if assert.NoError(t, err) {
+		r.Body.Close()
+		assert.Equal(t, http.StatusUpgradeRequired, r.StatusCode, "plain requests should be rejected")
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/chat?room=1", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	r, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		r.Body.Close()
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+		request := <-channel
+		assert.Equal(t, "websocket", request.Protocol)
+		assert.Equal(t, "ws://"+server.Listener.Addr().String()+"/chat?room=1", request.URL)
+	}
+}
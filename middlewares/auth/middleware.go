@@ -9,10 +9,18 @@ import (
 )
 
 type Auth struct {
-	nextHandler Handler
+	NextHandler
 }
 
-func (a Auth) Handle(request *Request) (*Response, error) {
+// New builds an Auth middleware, which has no parameters.
+func New(decode func(params interface{}) error) (Middleware, error) {
+	if err := decode(&struct{}{}); err != nil {
+		return nil, err
+	}
+	return &Auth{}, nil
+}
+
+func (a *Auth) OnRequest(request *Request) (*Response, error) {
 	authHeader, ok := request.HttpHeaders["authorization"]
 	if !ok || len(authHeader) < 1 {
 		writer := ioutil.NopCloser(bytes.NewBufferString("403 forbidden"))
@@ -29,10 +37,5 @@ func (a Auth) Handle(request *Request) (*Response, error) {
 		}, nil
 	}
 	logrus.Info("Auth middleware")
-	resp, _ := a.nextHandler.Handle(request)
-	return resp, nil
+	return nil, nil
 }
-
-func (a Auth) SetNext(handler Handler) {
-	a.nextHandler = handler
-}
\ No newline at end of file
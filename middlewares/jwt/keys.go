@@ -0,0 +1,283 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultJwksRefresh = 5 * time.Minute
+
+// jwksMinRefresh limits how often tokens of unknown keys fetch the key set.
+var jwksMinRefresh = 10 * time.Second
+
+var errSignature = errors.New("invalid signature")
+
+func decodeBase64(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := decodeBase64(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func verifyHS256(secret []byte, signed string, signature []byte) error {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errSignature
+	}
+	return nil
+}
+
+// verify checks an RS256 or ES256 signature with key.
+func verify(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return errSignature
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || key.Curve != elliptic.P256() || len(signature) != 64 {
+			return errSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errSignature
+		}
+		return nil
+	}
+	return errSignature
+}
+
+// readPublicKey reads the rsa or ecdsa public key of a pem file, which may
+// be a certificate.
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: unable to read %s. error=%v", file, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("invalid config: no pem block in %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		var certificate *x509.Certificate
+		if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = certificate.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: unable to parse %s. error=%v", file, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid config: key in %s is not an rsa or ecdsa key", file)
+}
+
+// jwks is a json web key set, fetched again when it is older than refresh
+// or has no key for a kid. The last keys are kept while it can not be
+// fetched. Keys are fetched in the background, one fetch at a time, so
+// tokens of known keys are checked with the current keys meanwhile.
+type jwks struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mtx     sync.Mutex
+	keys    []jwksKey
+	fetched time.Time
+	expires time.Time
+	// fetching is closed when the fetch in flight is done, nil when no
+	// fetch is in flight.
+	fetching chan struct{}
+}
+
+type jwksKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// jwk is a key of a json web key set, see RFC 7517.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJwks(url string, refresh time.Duration) *jwks {
+	return &jwks{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// prefetch fetches the keys before the first token is checked.
+func (s *jwks) prefetch() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.startFetch(time.Now())
+}
+
+// lookup returns the keys of kid and the keys without kid, or all keys if
+// kid is empty. A token of a key which is not known yet waits for the keys
+// being fetched.
+func (s *jwks) lookup(kid string) []crypto.PublicKey {
+	s.mtx.Lock()
+	now := time.Now()
+	missing := len(s.keys) == 0 || kid != "" && !s.has(kid)
+	if (missing || now.After(s.expires)) && now.Sub(s.fetched) >= jwksMinRefresh {
+		s.startFetch(now)
+	}
+	fetching := s.fetching
+	s.mtx.Unlock()
+
+	if missing && fetching != nil {
+		<-fetching
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var keys []crypto.PublicKey
+	for _, key := range s.keys {
+		if kid == "" || key.kid == "" || key.kid == kid {
+			keys = append(keys, key.key)
+		}
+	}
+	return keys
+}
+
+// startFetch fetches the keys in the background unless a fetch is in
+// flight. It is called with mtx held.
+func (s *jwks) startFetch(now time.Time) {
+	if s.fetching != nil {
+		return
+	}
+	s.fetched = now
+	fetching := make(chan struct{})
+	s.fetching = fetching
+	go func() {
+		keys, err := s.fetch()
+		s.mtx.Lock()
+		if err != nil {
+			logrus.WithError(err).Errorf("unable to fetch json web keys of %s, using the last keys", s.url)
+		} else {
+			s.keys = keys
+			s.expires = time.Now().Add(s.refresh)
+		}
+		s.fetching = nil
+		s.mtx.Unlock()
+		close(fetching)
+	}()
+}
+
+func (s *jwks) has(kid string) bool {
+	for _, key := range s.keys {
+		if key.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jwks) fetch() ([]jwksKey, error) {
+	response, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status of %s is %d", s.url, response.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid json web key set. error=%v", err)
+	}
+
+	var keys []jwksKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logrus.WithError(err).Warnf("skipping json web key %q of %s", k.Kid, s.url)
+			continue
+		}
+		keys = append(keys, jwksKey{kid: k.Kid, key: key})
+	}
+	logrus.Debugf("fetched %d json web keys of %s", len(keys), s.url)
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("curve %s is not supported", k.Crv)
+		}
+		x, err := decodeBase64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("key type %s is not supported", k.Kty)
+}
@@ -0,0 +1,342 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Params are the parameters of the jwt middleware. At least one of Secret,
+// PublicKeyFile and JwksUrl is needed.
+type Params struct {
+	// Algorithms are the accepted signing algorithms, by default those the
+	// keys are for: HS256 for Secret, RS256 and ES256 for the public keys.
+	Algorithms []string
+	// Secret is the key of HS256 tokens.
+	Secret string
+	// PublicKeyFile is a pem file of an rsa or ecdsa public key, or of a
+	// certificate.
+	PublicKeyFile string
+	// JwksUrl is a json web key set. It is fetched when the middleware is
+	// built, again every JwksRefresh, 5m by default, and when a token is
+	// signed by a key it does not have.
+	JwksUrl     string
+	JwksRefresh time.Duration
+
+	// Issuer and Audience, one of them, are required in the claims when set.
+	Issuer   string
+	Audience []string
+	// Skew is the clock skew allowed in checking exp and nbf.
+	Skew time.Duration
+	// Scopes are required in the scope or scp claim.
+	Scopes []string
+	// Headers maps claims to the headers they are sent to the backend in.
+	// Headers of the request with the same names are removed. Claim names
+	// are matched case-insensitively, as keys of the config are lowercased,
+	// a claim of the exact name first.
+	Headers map[string]string
+}
+
+// JWT passes on requests whose bearer token is a valid json web token.
+type JWT struct {
+	NextHandler
+	config     Params
+	algorithms map[string]bool
+	secret     []byte
+	key        crypto.PublicKey
+	jwks       *jwks
+}
+
+// New builds a JWT middleware from its Params.
+func New(decode func(params interface{}) error) (Middleware, error) {
+	var config Params
+	if err := decode(&config); err != nil {
+		return nil, err
+	}
+	return newJWT(config)
+}
+
+func newJWT(config Params) (*JWT, error) {
+	j := &JWT{config: config, algorithms: make(map[string]bool)}
+	if config.Secret == "" && config.PublicKeyFile == "" && config.JwksUrl == "" {
+		return nil, fmt.Errorf("invalid config: jwt needs a secret, a public key file or a jwks url")
+	}
+	if config.Secret != "" {
+		j.secret = []byte(config.Secret)
+	}
+	if config.PublicKeyFile != "" {
+		key, err := readPublicKey(config.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		j.key = key
+	}
+	if config.JwksUrl != "" {
+		refresh := config.JwksRefresh
+		if refresh <= 0 {
+			refresh = defaultJwksRefresh
+		}
+		j.jwks = newJwks(config.JwksUrl, refresh)
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		if j.secret != nil {
+			algorithms = append(algorithms, "HS256")
+		}
+		if j.key != nil || j.jwks != nil {
+			algorithms = append(algorithms, "RS256", "ES256")
+		}
+	}
+	for _, algorithm := range algorithms {
+		switch algorithm {
+		case "HS256":
+			if j.secret == nil {
+				return nil, fmt.Errorf("invalid config: HS256 needs a secret")
+			}
+		case "RS256", "ES256":
+			if j.key == nil && j.jwks == nil {
+				return nil, fmt.Errorf("invalid config: %s needs a public key file or a jwks url", algorithm)
+			}
+		default:
+			return nil, fmt.Errorf("invalid config: algorithm %s is not supported", algorithm)
+		}
+		j.algorithms[algorithm] = true
+	}
+	if config.Skew < 0 {
+		return nil, fmt.Errorf("invalid config: skew is negative")
+	}
+	if j.jwks != nil {
+		j.jwks.prefetch()
+	}
+	return j, nil
+}
+
+func (j *JWT) OnRequest(request *Request) (*Response, error) {
+	for _, header := range j.config.Headers {
+		request.HttpHeaders.Del(header)
+	}
+	token := bearerToken(request.HttpHeaders)
+	if token == "" {
+		return reject(http.StatusUnauthorized, `Bearer`, "no bearer token"), nil
+	}
+	claims, err := j.verify(token, time.Now())
+	if err != nil {
+		logrus.WithError(err).Debug("rejecting json web token")
+		return reject(http.StatusUnauthorized, `Bearer error="invalid_token"`, "invalid token"), nil
+	}
+	if missing := missingScopes(claims, j.config.Scopes); len(missing) > 0 {
+		logrus.Debugf("json web token misses scopes %v", missing)
+		return reject(http.StatusForbidden, `Bearer error="insufficient_scope", scope="`+strings.Join(j.config.Scopes, " ")+`"`, "insufficient scope"), nil
+	}
+	for claim, header := range j.config.Headers {
+		if value, ok := claimString(lookupClaim(claims, claim)); ok {
+			request.HttpHeaders.Set(header, value)
+		}
+	}
+	return nil, nil
+}
+
+func bearerToken(headers http.Header) string {
+	authorization := headers.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[7:])
+}
+
+func reject(status int, challenge, message string) *Response {
+	return &Response{
+		HttpStatus:  status,
+		HttpHeaders: http.Header{"Www-Authenticate": {challenge}},
+		Body:        ioutil.NopCloser(bytes.NewBufferString(strconv.Itoa(status) + " " + message)),
+	}
+}
+
+// verify checks the signature and the claims of token, and returns its
+// claims.
+func (j *JWT) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token has %d parts", len(parts))
+	}
+	var header struct {
+		Alg string
+		Kid string
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header. error=%v", err)
+	}
+	if !j.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %q is not accepted", header.Alg)
+	}
+	signature, err := decodeBase64(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature. error=%v", err)
+	}
+	if err := j.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims. error=%v", err)
+	}
+	if err := j.verifyClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (j *JWT) verifySignature(alg, kid, signed string, signature []byte) error {
+	if alg == "HS256" {
+		return verifyHS256(j.secret, signed, signature)
+	}
+	keys := make([]crypto.PublicKey, 0, 1)
+	if j.key != nil {
+		keys = append(keys, j.key)
+	}
+	if j.jwks != nil {
+		keys = append(keys, j.jwks.lookup(kid)...)
+	}
+	for _, key := range keys {
+		if verify(alg, key, signed, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no key of kid %q verifies the signature", kid)
+}
+
+func (j *JWT) verifyClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no exp")
+	}
+	if now.Add(-j.config.Skew).After(unixTime(exp)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		seconds, ok := nbf.(float64)
+		if !ok {
+			return fmt.Errorf("invalid nbf")
+		}
+		if now.Add(j.config.Skew).Before(unixTime(seconds)) {
+			return fmt.Errorf("token is not valid yet")
+		}
+	}
+	if j.config.Issuer != "" && claims["iss"] != j.config.Issuer {
+		return fmt.Errorf("issuer %v is not accepted", claims["iss"])
+	}
+	if len(j.config.Audience) > 0 && !hasAudience(claims["aud"], j.config.Audience) {
+		return fmt.Errorf("audience %v is not accepted", claims["aud"])
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// hasAudience reports whether aud, a string or a list of them, has one of
+// audience.
+func hasAudience(aud interface{}, audience []string) bool {
+	for _, value := range stringList(aud) {
+		for _, accepted := range audience {
+			if value == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingScopes returns the scopes which are not in the scope claim, a space
+// separated string, or in the scp claim, a string or a list of them.
+func missingScopes(claims map[string]interface{}, scopes []string) []string {
+	granted := make(map[string]bool)
+	if scope, ok := claims["scope"].(string); ok {
+		for _, s := range strings.Fields(scope) {
+			granted[s] = true
+		}
+	}
+	for _, s := range stringList(claims["scp"]) {
+		for _, s := range strings.Fields(s) {
+			granted[s] = true
+		}
+	}
+	var missing []string
+	for _, scope := range scopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+func stringList(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// lookupClaim returns the claim of name, else a claim whose name differs
+// only in case, the first in sorted order if there are more.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if value, ok := claims[name]; ok {
+		return value
+	}
+	var value interface{}
+	found, ok := "", false
+	for claim, v := range claims {
+		if strings.EqualFold(claim, name) && (!ok || claim < found) {
+			value, found, ok = v, claim, true
+		}
+	}
+	return value
+}
+
+// claimString formats a claim as a header value. Lists are joined by commas
+// and objects are sent as json.
+func claimString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := claimString(v); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ","), true
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(content), true
+}
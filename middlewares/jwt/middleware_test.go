@@ -0,0 +1,346 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+type nextHandler struct {
+	calls   int
+	request *Request
+}
+
+func (h *nextHandler) Handle(request *Request) (*Response, error) {
+	h.calls++
+	h.request = request
+	return &Response{HttpStatus: http.StatusOK}, nil
+}
+
+func encode(v interface{}) string {
+	content, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// sign builds a token of claims signed with key, a secret, an rsa or an
+// ecdsa private key.
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		assert.NoError(t, err)
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func claims(values map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+func handle(j *JWT, next *nextHandler, token string, headers http.Header) *Response {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	j.SetNext(next)
+	request := &Request{Protocol: "http", HttpHeaders: headers}
+	response, err := j.OnRequest(request)
+	if err != nil {
+		return nil
+	}
+	if response == nil {
+		response, _ = j.Handle(request)
+	}
+	return response
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("secret")
+	j, err := newJWT(Params{
+		Secret:   "secret",
+		Issuer:   "https://auth.example.com",
+		Audience: []string{"gateway", "api"},
+		Skew:     time.Minute,
+		Scopes:   []string{"orders:read"},
+		Headers:  map[string]string{"sub": "X-User-Id", "roles": "X-User-Roles", "tenantid": "X-Tenant"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	valid := map[string]interface{}{
+		"iss":   "https://auth.example.com",
+		"aud":   []string{"web", "api"},
+		"scope": "orders:read orders:write",
+		"sub":   "42",
+		"roles": []string{"admin", "staff"},
+		// matched by "tenantid", the config lowercases the names of claims
+		"tenantId": "acme",
+	}
+
+	next := &nextHandler{}
+	response := handle(j, next, sign(t, "HS256", "", secret, claims(valid)), http.Header{"X-User-Id": {"1"}})
+	if assert.Equal(t, http.StatusOK, response.HttpStatus) {
+		assert.Equal(t, []string{"42"}, next.request.HttpHeaders["X-User-Id"], "spoofed header is passed on")
+		assert.Equal(t, "admin,staff", next.request.HttpHeaders.Get("X-User-Roles"))
+		assert.Equal(t, "acme", next.request.HttpHeaders.Get("X-Tenant"))
+	}
+
+	response = handle(j, next, "", http.Header{"X-User-Id": {"1"}})
+	assert.Equal(t, http.StatusUnauthorized, response.HttpStatus)
+	assert.Equal(t, "Bearer", response.HttpHeaders.Get("Www-Authenticate"))
+
+	now := time.Now()
+	for name, c := range map[string]map[string]interface{}{
+		"expired":          {"exp": now.Add(-2 * time.Minute).Unix()},
+		"not valid yet":    {"nbf": now.Add(2 * time.Minute).Unix()},
+		"without exp":      {"exp": nil},
+		"of another iss":   {"iss": "https://evil.example.com"},
+		"of another aud":   {"aud": "web"},
+		"without audience": {"aud": nil},
+	} {
+		token := claims(valid)
+		for k, v := range c {
+			if v == nil {
+				delete(token, k)
+			} else {
+				token[k] = v
+			}
+		}
+		response := handle(j, next, sign(t, "HS256", "", secret, token), nil)
+		assert.Equal(t, http.StatusUnauthorized, response.HttpStatus, "token %s is accepted", name)
+	}
+
+	// within the skew
+	skewed := claims(valid)
+	skewed["exp"] = now.Add(-30 * time.Second).Unix()
+	skewed["nbf"] = now.Add(30 * time.Second).Unix()
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "HS256", "", secret, skewed), nil).HttpStatus)
+
+	unscoped := claims(valid)
+	unscoped["scope"] = "orders:write"
+	response = handle(j, next, sign(t, "HS256", "", secret, unscoped), nil)
+	assert.Equal(t, http.StatusForbidden, response.HttpStatus)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="orders:read"`, response.HttpHeaders.Get("Www-Authenticate"))
+	delete(unscoped, "scope")
+	unscoped["scp"] = []string{"orders:read"}
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "HS256", "", secret, unscoped), nil).HttpStatus)
+
+	calls := next.calls
+	for name, token := range map[string]string{
+		"of another secret": sign(t, "HS256", "", []byte("other"), claims(valid)),
+		"without signature": encode(map[string]string{"alg": "none"}) + "." + encode(claims(valid)) + ".",
+		"malformed":         "abc.def",
+	} {
+		response := handle(j, next, token, nil)
+		assert.Equal(t, http.StatusUnauthorized, response.HttpStatus, "token %s is accepted", name)
+	}
+	assert.Equal(t, calls, next.calls)
+}
+
+func TestJWTPublicKeyFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jwt")
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	file := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	j, err := newJWT(Params{PublicKeyFile: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+	next := &nextHandler{}
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "RS256", "", rsaKey, claims(nil)), nil).HttpStatus)
+
+	// a token of the public key used as a hmac secret
+	assert.Equal(t, http.StatusUnauthorized, handle(j, next, sign(t, "HS256", "", der, claims(nil)), nil).HttpStatus)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, http.StatusUnauthorized, handle(j, next, sign(t, "RS256", "", other, claims(nil)), nil).HttpStatus)
+
+	_, err = newJWT(Params{PublicKeyFile: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestJWTJwks(t *testing.T) {
+	defer func(d time.Duration) { jwksMinRefresh = d }(jwksMinRefresh)
+	jwksMinRefresh = 0
+
+	ecKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		return key
+	}
+	jwkOf := func(kid string, key *ecdsa.PrivateKey) map[string]string {
+		return map[string]string{
+			"kid": kid,
+			"kty": "EC",
+			"crv": "P-256",
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaJwk := map[string]string{
+		"kid": "rsa",
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}
+	first, second := ecKey(), ecKey()
+
+	var mtx sync.Mutex
+	fetches := 0
+	keys := []map[string]string{jwkOf("1", first), rsaJwk}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	j, err := newJWT(Params{JwksUrl: server.URL, JwksRefresh: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	next := &nextHandler{}
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "ES256", "1", first, claims(nil)), nil).HttpStatus)
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "RS256", "rsa", rsaKey, claims(nil)), nil).HttpStatus)
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "ES256", "1", first, claims(nil)), nil).HttpStatus)
+	assert.Equal(t, 1, fetches, "cached keys are fetched again")
+
+	// the keys are rotated
+	mtx.Lock()
+	keys = []map[string]string{jwkOf("2", second)}
+	mtx.Unlock()
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "ES256", "2", second, claims(nil)), nil).HttpStatus)
+	assert.Equal(t, 2, fetches)
+	assert.Equal(t, http.StatusUnauthorized, handle(j, next, sign(t, "ES256", "1", first, claims(nil)), nil).HttpStatus)
+
+	// the last keys are kept while the key set is not available
+	server.Close()
+	assert.Equal(t, http.StatusOK, handle(j, next, sign(t, "ES256", "2", second, claims(nil)), nil).HttpStatus)
+	assert.Equal(t, http.StatusUnauthorized, handle(j, next, sign(t, "ES256", "3", ecKey(), claims(nil)), nil).HttpStatus)
+}
+
+func TestJWTConfig(t *testing.T) {
+	for name, config := range map[string]Params{
+		"without key":                 {},
+		"of unsupported algorithm":    {Secret: "secret", Algorithms: []string{"none"}},
+		"of RS256 without public key": {Secret: "secret", Algorithms: []string{"RS256"}},
+		"of HS256 without secret":     {JwksUrl: "http://localhost/jwks", Algorithms: []string{"HS256"}},
+		"of negative skew":            {Secret: "secret", Skew: -time.Second},
+	} {
+		_, err := newJWT(config)
+		assert.Error(t, err, "config %s is accepted", name)
+	}
+}
+
+func TestJWTJwksInBackground(t *testing.T) {
+	defer func(d time.Duration) { jwksMinRefresh = d }(jwksMinRefresh)
+	jwksMinRefresh = 0
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fetched, release := make(chan bool, 10), make(chan bool)
+	slow := false
+	var mtx sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		wait := slow
+		mtx.Unlock()
+		if wait {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "1",
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}}})
+		fetched <- true
+	}))
+	defer server.Close()
+
+	j, err := newJWT(Params{JwksUrl: server.URL, JwksRefresh: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("the keys are not fetched when the middleware is built")
+	}
+
+	// the keys expired and the key set is slow
+	mtx.Lock()
+	slow = true
+	mtx.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	token := sign(t, "ES256", "1", key, claims(nil))
+	statuses := make(chan int)
+	go func() {
+		for i := 0; i < 3; i++ {
+			statuses <- handle(j, &nextHandler{}, token, nil).HttpStatus
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case status := <-statuses:
+			assert.Equal(t, http.StatusOK, status)
+		case <-time.After(time.Second):
+			t.Fatal("tokens of known keys wait for the key set")
+		}
+	}
+	close(release)
+	<-fetched
+	assert.Len(t, fetched, 0, "the key set is fetched more than once at a time")
+}
@@ -1,10 +1,59 @@
 package middlewares
 
 import (
+	"fmt"
 	. "github.com/k3rn3l-p4n1c/apigateway"
 	"github.com/k3rn3l-p4n1c/apigateway/middlewares/auth"
+	"github.com/k3rn3l-p4n1c/apigateway/middlewares/jwt"
+	"github.com/mitchellh/mapstructure"
+	"sync"
 )
 
-var Middlewares = map[string]Middleware{
-	"auth": auth.Auth{},
+// Factory builds a new instance of a middleware. decode fills the typed
+// parameters of the middleware, a pointer to a struct, from its definition
+// and fails on parameters the struct does not have.
+type Factory func(decode func(params interface{}) error) (Middleware, error)
+
+var (
+	mtx       sync.RWMutex
+	factories = map[string]Factory{
+		"auth": auth.New,
+		"jwt":  jwt.New,
+	}
+)
+
+// Register makes a middleware type available to the middleware definitions
+// of the config.
+func Register(name string, factory Factory) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	factories[name] = factory
+}
+
+// New builds a new instance of the middleware type name with params.
+func New(name string, params map[string]interface{}) (Middleware, error) {
+	mtx.RLock()
+	factory, ok := factories[name]
+	mtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("middleware %s is not supported", name)
+	}
+	return factory(func(result interface{}) error {
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.StringToSliceHookFunc(","),
+			),
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			Result:           result,
+		})
+		if err != nil {
+			return err
+		}
+		if err := decoder.Decode(params); err != nil {
+			return fmt.Errorf("invalid parameters of middleware %s. error=%v", name, err)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/k3rn3l-p4n1c/apigateway/middlewares/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New("missing", nil)
+	assert.EqualError(t, err, "middleware missing is not supported")
+
+	first, err := New("auth", nil)
+	assert.NoError(t, err)
+	second, err := New("auth", map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.False(t, first == second, "middlewares share an instance")
+
+	_, err = New("auth", map[string]interface{}{"secret": "xxx"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid parameters of middleware auth")
+	}
+
+	var params jwt.Params
+	Register("params", func(decode func(params interface{}) error) (Middleware, error) {
+		return nil, decode(&params)
+	})
+	_, err = New("params", map[string]interface{}{
+		"secret":  "xxx",
+		"skew":    "30s",
+		"scopes":  "orders:read,orders:write",
+		"headers": map[string]interface{}{"sub": "X-User-Id"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 30*time.Second, params.Skew)
+		assert.Equal(t, []string{"orders:read", "orders:write"}, params.Scopes)
+		assert.Equal(t, map[string]string{"sub": "X-User-Id"}, params.Headers)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"regexp"
 	"time"
 )
 
@@ -13,47 +14,308 @@ type Config struct {
 	EntryPoints []*EntryPoint
 	Frontend    []*Frontend
 	Backend     []*Backend
+	RetryBudget RetryBudget
+	// Middlewares are the definitions of the middlewares frontends name.
+	// The type key of a definition is the type of the middleware, the name
+	// of the definition when not set, and the other keys its parameters.
+	Middlewares map[string]map[string]interface{}
 }
 
 type EntryPoint struct {
 	Protocol string
 	Enabled  *bool
 	Addr     string
+	TLS      *TLS
+	// IdleTimeout closes upgraded connections, e.g. websockets, when no
+	// data is sent in either direction for this long.
+	IdleTimeout time.Duration
+}
+
+type TLS struct {
+	CertFile     string
+	KeyFile      string
+	Certificates []Certificate
+	MinVersion   string
+	CipherSuites []string
+	ClientAuth   *ClientAuth
+	ACME         *ACME
+}
+
+// ACME makes an entrypoint obtain and renew certificates for the hosts of
+// its frontends from an ACME server, e.g. Let's Encrypt. The tls-alpn-01
+// challenge is answered on the entrypoint itself and http-01 is answered on
+// HTTPChallengeAddr when it is set.
+type ACME struct {
+	DirectoryURL      string
+	Email             string
+	CacheDir          string
+	CAFile            string
+	HTTPChallengeAddr string
+	RenewBefore       time.Duration
+}
+
+// ClientAuth makes an entrypoint require client certificates issued by one
+// of the CAs in CAFile and not revoked by the CRL in CRLFile.
+type ClientAuth struct {
+	CAFile   string
+	CRLFile  string
+	Optional bool
+}
+
+// ClientIdentity is the verified certificate of a mutual tls client.
+type ClientIdentity struct {
+	Subject        string
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+}
+
+type Certificate struct {
+	CertFile string
+	KeyFile  string
 }
 
 type MatchCondition struct {
-	Host   string
-	Query  map[string]string
-	Header map[string]string
-	Method string
+	Host       string
+	Query      map[string]string
+	Header     map[string]string
+	Method     string
+	ClientName string
+	// GrpcService is the fully qualified service name of a grpc call,
+	// e.g. grpc.health.v1.Health, and GrpcMethod the method name, e.g. Check.
+	GrpcService string
+	GrpcMethod  string
+	// Path matches the request path exactly, unless it is a template like
+	// /users/{id} or /files/{name:.+}. PathPrefix matches whole segments,
+	// /api matches /api and /api/users but not /apiv2. Values captured by
+	// a template or by named groups of PathRegex are set on the request.
+	Path       string
+	PathPrefix string
+	PathRegex  string
+}
+
+// Rewrite changes the path of the requests of a frontend before they are
+// sent to the backend. StripPrefix is removed first, then Regex is replaced
+// by Replacement, then Template, e.g. /v2/accounts/{id}, replaces the whole
+// path with the values captured by the frontend path matchers, and AddPrefix
+// is prepended last. The query of the request is kept.
+type Rewrite struct {
+	StripPrefix string
+	AddPrefix   string
+	Regex       string
+	Replacement string
+	Template    string
 }
+
 type Frontend struct {
 	Id              string   `mapstructure:"-"`
 	Protocol        string
 	Match           []MatchCondition
 	DestinationName string   `mapstructure:"destination"`
 	MiddlewareNames []string `mapstructure:"middlewares"`
+	Rewrite         *Rewrite
+	// Priority orders frontends whose conditions match the same request,
+	// the highest first. Frontends of the same priority are ordered by how
+	// specific their conditions are: exact paths before templates, regexes
+	// and prefixes, longer prefixes first, then conditions with a host.
+	Priority int
+
+	// MaxConnections limits the upgraded connections, e.g. websockets,
+	// open at the same time through the frontend. Zero means no limit.
+	MaxConnections int64
 
 	Destination *Backend     `mapstructure:"-"`
 	Middlewares []Middleware `mapstructure:"-"`
+	// RewriteRegex is Rewrite.Regex compiled when the config is loaded.
+	RewriteRegex *regexp.Regexp `mapstructure:"-"`
 }
 
 type Backend struct {
-	Name        string
-	Protocol    string
-	Discovery   Discovery
-	Timeout     time.Duration
-	Path        string
-	Scheme      string
-	ForwardHost bool
-	Host        string
+	Name             string
+	Protocol         string
+	Discovery        Discovery
+	LoadBalancer     LoadBalancer
+	HealthCheck      *HealthCheck
+	OutlierDetection *OutlierDetection
+	CircuitBreaker   *CircuitBreaker
+	Retry            *Retry
+	Hedge            *Hedge
+	Timeout          time.Duration
+	Path             string
+	Scheme           string
+	ForwardHost      bool
+	Host             string
 
 	ReverseProxy ReverseProxy `mapstructure:"-"`
 }
 
+// Discovery finds the endpoints of a backend. Type is static, dns, consul,
+// kubernetes or file.
 type Discovery struct {
 	Type string
-	Url  string
+	// Url is the address of the backend for static and dns discovery. dns
+	// resolves domains like _http._tcp.example.com as SRV records.
+	// For consul it is the address of the Consul agent.
+	Url string
+
+	// Service is the name of the service watched in consul or kubernetes.
+	Service string
+	// Tags are required on every consul instance of Service.
+	Tags []string
+	// Datacenter is the one of the Consul agent when not set.
+	Datacenter string
+	// PassingOnly leaves out consul instances with a warning check too.
+	// Like the dns of Consul, those with a critical check are always left out.
+	PassingOnly bool
+
+	// Namespace holds the EndpointSlices of Service in kubernetes, the one
+	// of the kubeconfig context or of the gateway pod when not set.
+	Namespace string
+	// PortName is the port of the ready endpoints, which may be left out
+	// when the service has one port.
+	PortName string
+	// Kubeconfig is the cluster to watch, the one the gateway runs in when
+	// not set.
+	Kubeconfig string
+
+	// Resolver is the dns server to ask, else the name servers of the system.
+	// Domains other than SRV ones are resolved by the system unless it is set.
+	Resolver string
+
+	// Path is a json or yaml file of endpoints, or a directory of them, read
+	// again when they change.
+	Path string
+
+	// Endpoints lists the endpoints of static discovery with their weights
+	// and zones, instead of Url.
+	Endpoints []StaticEndpoint
+}
+
+// StaticEndpoint is an endpoint of static discovery. Address is a host or
+// host:port, a weight of 0 is 1.
+type StaticEndpoint struct {
+	Address  string
+	Weight   int
+	Zone     string
+	Metadata map[string]string
+}
+
+// LoadBalancer picks the endpoint of a backend each request is sent to.
+// Strategy is one of round-robin (the default), weighted-round-robin,
+// least-connections, p2c (power of two choices) and consistent-hash.
+// Consistent hashing uses the HashHeader header, else the HashCookie
+// cookie, else the client ip of the request as key. Zone is the zone of the
+// gateway, whose endpoints are preferred while there are any.
+type LoadBalancer struct {
+	Strategy   string
+	HashHeader string
+	HashCookie string
+	Zone       string
+}
+
+// HealthCheck probes the endpoints of a backend in the background. Type is
+// http (the default) or tcp. An http probe requests Path and expects
+// ExpectedStatus, or any 2xx status when it is not set. An endpoint is
+// taken out of balancing after UnhealthyThreshold failed probes in a row
+// and put back after HealthyThreshold successful ones.
+type HealthCheck struct {
+	Type               string
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	ExpectedStatus     int
+}
+
+// OutlierDetection ejects an endpoint from balancing after
+// ConsecutiveErrors 5xx responses or connection errors in a row. It stays
+// ejected for BaseEjectionTime times the number of its ejections since it
+// last answered well. No more than MaxEjectionPercent of the endpoints are
+// ejected at once and never all of them.
+type OutlierDetection struct {
+	ConsecutiveErrors  int
+	BaseEjectionTime   time.Duration
+	MaxEjectionPercent int
+}
+
+// CircuitBreaker stops calling a backend which keeps failing. The circuit
+// opens when at least MinRequests requests were made in the last Window and
+// ErrorPercent of them failed, with an error or a 5xx status, or
+// SlowPercent of them took longer than SlowThreshold. After OpenTimeout
+// HalfOpenRequests requests are let through, and the circuit closes if
+// they all succeed. Requests are answered by Fallback while it is open.
+type CircuitBreaker struct {
+	Window           time.Duration
+	MinRequests      int
+	ErrorPercent     int
+	SlowThreshold    time.Duration
+	SlowPercent      int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+	Fallback         Fallback
+}
+
+// Fallback answers the requests to a backend whose circuit is open. Cache
+// answers with the last good response of the same url if there is one,
+// leaving out requests with credentials and private responses, otherwise
+// Backend, the name of another backend, is called, otherwise
+// Status, Headers and Body are the response.
+type Fallback struct {
+	Cache   bool
+	Backend string
+	Status  int
+	Headers map[string]string
+	Body    string
+}
+
+// Retry sends a failed request to the backend again, to another endpoint
+// if there is one. On lists the failures which are retried: connect-error,
+// a connection which failed or was reset before the response, timeout, and
+// the statuses 502, 503 and 504. Only idempotent methods are retried unless
+// NonIdempotent is set. Request bodies up to MaxBodySize bytes are kept to
+// be sent again, requests with larger bodies are not retried. Attempts wait
+// a random time up to Backoff doubled for each retry and at most MaxBackoff.
+type Retry struct {
+	On            []string
+	MaxAttempts   int
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	NonIdempotent bool
+	MaxBodySize   int64
+}
+
+// Hedge sends a request again to another endpoint when the first endpoint
+// has not answered within Delay, or within the Percentile latency of the
+// backend once enough responses were seen. The first good response is
+// returned and the other request is cancelled. Like retries, only idempotent
+// methods with bodies up to MaxBodySize bytes are hedged unless NonIdempotent
+// is set. The hedges fired and won by each backend are served by the metrics
+// entrypoint.
+type Hedge struct {
+	Percentile    float64
+	Delay         time.Duration
+	NonIdempotent bool
+	MaxBodySize   int64
+}
+
+// RetryBudget limits the retries to all backends to Percent of the requests
+// of the last ten seconds, besides MinRetriesPerSecond which are always
+// allowed, so a failing backend does not get a storm of retries.
+type RetryBudget struct {
+	Percent             int
+	MinRetriesPerSecond int
+}
+
+// Endpoint is an instance of a backend found by service discovery. A zero
+// Port means the port of the backend host.
+type Endpoint struct {
+	IP       string
+	Port     int
+	Weight   int
+	Zone     string
+	Metadata map[string]string
 }
 
 type Handler interface {
@@ -61,7 +323,7 @@ type Handler interface {
 }
 
 type ServiceDiscovery interface {
-	Get(addr string) (ip string, err error)
+	Endpoints() ([]Endpoint, error)
 }
 
 type Middleware interface {
@@ -69,6 +331,54 @@ type Middleware interface {
 	SetNext(handler Handler)
 }
 
+// A middleware may implement the hooks below besides Handle. The hooks of
+// the middlewares of a frontend run in the order the middlewares are named
+// for requests, and in the reverse order for responses, errors and
+// completions.
+
+// RequestHook is called before the request is passed to Handle. A response
+// or an error it returns is passed back without calling Handle, and without
+// the other hooks of the same middleware.
+type RequestHook interface {
+	OnRequest(request *Request) (*Response, error)
+}
+
+// ResponseHook is called with the response of Handle, and may change its
+// status and headers, or wrap its body. The response it returns is passed
+// back instead.
+type ResponseHook interface {
+	OnResponse(request *Request, response *Response) (*Response, error)
+}
+
+// ErrorHook is called with the error of Handle. A response it returns is
+// passed back instead of the error, an error it returns instead of the
+// error of Handle.
+type ErrorHook interface {
+	OnError(request *Request, err error) (*Response, error)
+}
+
+// CompleteHook is called once the response is written to the client, or the
+// writing stopped, with the bytes sent and the time since the request was
+// passed to the middlewares.
+type CompleteHook interface {
+	OnComplete(request *Request, response *Response, completion Completion)
+}
+
+type Completion struct {
+	BytesSent int64
+	Duration  time.Duration
+}
+
+// NextHandler passes requests to the next handler. Middlewares which only
+// implement hooks embed it.
+type NextHandler struct {
+	Handler
+}
+
+func (n *NextHandler) SetNext(handler Handler) {
+	n.Handler = handler
+}
+
 type ReverseProxy interface {
 	Handler
 }
@@ -79,11 +389,16 @@ type Request struct {
 	CtxCancel context.CancelFunc
 	ClientIP  string
 
+	ClientIdentity *ClientIdentity
+
 	URL string
+	// PathParams holds the path values captured by the matched frontend.
+	PathParams map[string]string
 
-	Body        io.ReadCloser
-	HttpHeaders http.Header
-	HttpMethod  string
+	Body         io.ReadCloser
+	HttpHeaders  http.Header
+	HttpTrailers http.Header
+	HttpMethod   string
 }
 
 type Response struct {
@@ -91,6 +406,9 @@ type Response struct {
 	Body        io.ReadCloser
 	HttpStatus  int
 	HttpHeaders http.Header
+	// HttpTrailers is announced before the body is written and its values
+	// are sent after it, so they may be filled while Body is being read.
+	HttpTrailers http.Header
 }
 
 type HandleFunc func(request *Request) *Response
@@ -0,0 +1,320 @@
+package reproxy
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var errNoEndpoint = errors.New("no endpoint is available")
+
+// Balancer picks the endpoint a request is sent to. done is called once the
+// request is finished, including its streamed response body.
+type Balancer interface {
+	Pick(request *Request, endpoints []Endpoint) (endpoint Endpoint, done func(), err error)
+}
+
+func NewBalancer(config LoadBalancer) (Balancer, error) {
+	switch config.Strategy {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "weighted-round-robin":
+		return &weightedRoundRobin{current: make(map[string]int)}, nil
+	case "least-connections":
+		return &leastConnections{inflight: newInflight()}, nil
+	case "p2c":
+		return &powerOfTwoChoices{inflight: newInflight()}, nil
+	case "consistent-hash":
+		return &consistentHash{config: config}, nil
+	default:
+		return nil, fmt.Errorf("load balancer strategy %s is not supported", config.Strategy)
+	}
+}
+
+func nop() {}
+
+// endpointKey identifies an endpoint across calls of Pick.
+func endpointKey(endpoint Endpoint) string {
+	return endpoint.IP + ":" + strconv.Itoa(endpoint.Port)
+}
+
+// endpointAddr returns the address of endpoint, using the port of host if
+// the endpoint has none.
+func endpointAddr(endpoint Endpoint, host string) string {
+	port := ""
+	if endpoint.Port != 0 {
+		port = strconv.Itoa(endpoint.Port)
+	} else if _, p, err := net.SplitHostPort(host); err == nil {
+		port = p
+	}
+	if port == "" {
+		if strings.IndexByte(endpoint.IP, ':') >= 0 {
+			return "[" + endpoint.IP + "]"
+		}
+		return endpoint.IP
+	}
+	return net.JoinHostPort(endpoint.IP, port)
+}
+
+func weight(endpoint Endpoint) int {
+	if endpoint.Weight <= 0 {
+		return 1
+	}
+	return endpoint.Weight
+}
+
+// inZone returns the endpoints in zone, or all of them if none is in zone
+// or zone is empty.
+func inZone(endpoints []Endpoint, zone string) []Endpoint {
+	if zone == "" {
+		return endpoints
+	}
+	var local []Endpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Zone == zone {
+			local = append(local, endpoint)
+		}
+	}
+	if len(local) == 0 {
+		return endpoints
+	}
+	return local
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (b *roundRobin) Pick(_ *Request, endpoints []Endpoint) (Endpoint, func(), error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, nop, errNoEndpoint
+	}
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return endpoints[n%uint64(len(endpoints))], nop, nil
+}
+
+// weightedRoundRobin is the smooth weighted round robin of nginx: heavier
+// endpoints are picked more often without being picked in bursts.
+type weightedRoundRobin struct {
+	mtx     sync.Mutex
+	current map[string]int
+}
+
+func (b *weightedRoundRobin) Pick(_ *Request, endpoints []Endpoint) (Endpoint, func(), error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, nop, errNoEndpoint
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	total, best := 0, -1
+	current := make(map[string]int, len(endpoints))
+	for i, endpoint := range endpoints {
+		key := endpointKey(endpoint)
+		w := weight(endpoint)
+		total += w
+		current[key] = b.current[key] + w
+		if best < 0 || current[key] > current[endpointKey(endpoints[best])] {
+			best = i
+		}
+	}
+	current[endpointKey(endpoints[best])] -= total
+	// endpoints which are gone are forgotten
+	b.current = current
+	return endpoints[best], nop, nil
+}
+
+// inflight counts the requests in flight per endpoint.
+type inflight struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+func newInflight() *inflight {
+	return &inflight{counts: make(map[string]int)}
+}
+
+func (f *inflight) count(endpoint Endpoint) int {
+	return f.counts[endpointKey(endpoint)]
+}
+
+// start counts a request to endpoint and returns the func which ends it.
+// It must be called with mtx held.
+func (f *inflight) start(endpoint Endpoint) func() {
+	key := endpointKey(endpoint)
+	f.counts[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mtx.Lock()
+			defer f.mtx.Unlock()
+			if f.counts[key]--; f.counts[key] <= 0 {
+				delete(f.counts, key)
+			}
+		})
+	}
+}
+
+// leastConnections picks the endpoint with the fewest requests in flight
+// relative to its weight. Ties are broken in turn.
+type leastConnections struct {
+	inflight *inflight
+	next     uint64
+}
+
+func (b *leastConnections) Pick(_ *Request, endpoints []Endpoint) (Endpoint, func(), error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, nop, errNoEndpoint
+	}
+	b.inflight.mtx.Lock()
+	defer b.inflight.mtx.Unlock()
+
+	offset := int(atomic.AddUint64(&b.next, 1) % uint64(len(endpoints)))
+	best := -1
+	for i := range endpoints {
+		j := (i + offset) % len(endpoints)
+		if best < 0 || b.load(endpoints[j]) < b.load(endpoints[best]) {
+			best = j
+		}
+	}
+	return endpoints[best], b.inflight.start(endpoints[best]), nil
+}
+
+func (b *leastConnections) load(endpoint Endpoint) float64 {
+	return float64(b.inflight.count(endpoint)) / float64(weight(endpoint))
+}
+
+// powerOfTwoChoices picks two endpoints at random and takes the one with
+// fewer requests in flight.
+type powerOfTwoChoices struct {
+	inflight *inflight
+}
+
+func (b *powerOfTwoChoices) Pick(_ *Request, endpoints []Endpoint) (Endpoint, func(), error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, nop, errNoEndpoint
+	}
+	b.inflight.mtx.Lock()
+	defer b.inflight.mtx.Unlock()
+
+	picked := endpoints[rand.Intn(len(endpoints))]
+	if len(endpoints) > 1 {
+		i := rand.Intn(len(endpoints) - 1)
+		other := endpoints[i]
+		if endpointKey(other) == endpointKey(picked) {
+			other = endpoints[len(endpoints)-1]
+		}
+		if b.inflight.count(other) < b.inflight.count(picked) {
+			picked = other
+		}
+	}
+	return picked, b.inflight.start(picked), nil
+}
+
+// consistentHash sends the requests of the same key to the same endpoint,
+// and moves only the keys of an endpoint when it is added or removed.
+type consistentHash struct {
+	config LoadBalancer
+	rr     roundRobin
+
+	mtx  sync.Mutex
+	ring *hashRing
+}
+
+const virtualNodes = 100
+
+type hashRing struct {
+	signature string
+	hashes    []uint64
+	endpoints []Endpoint
+}
+
+func (b *consistentHash) Pick(request *Request, endpoints []Endpoint) (Endpoint, func(), error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, nop, errNoEndpoint
+	}
+	key := b.key(request)
+	if key == "" {
+		return b.rr.Pick(request, endpoints)
+	}
+	ring := b.getRing(endpoints)
+	h := hash(key)
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.endpoints[i], nop, nil
+}
+
+func (b *consistentHash) key(request *Request) string {
+	if b.config.HashHeader != "" {
+		return request.HttpHeaders.Get(b.config.HashHeader)
+	}
+	if b.config.HashCookie != "" {
+		cookie, err := (&http.Request{Header: request.HttpHeaders}).Cookie(b.config.HashCookie)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	return request.ClientIP
+}
+
+// getRing returns the ring of endpoints, building it again only when the
+// endpoints changed.
+func (b *consistentHash) getRing(endpoints []Endpoint) *hashRing {
+	keys := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		keys[i] = endpointKey(endpoint) + "*" + strconv.Itoa(weight(endpoint))
+	}
+	sort.Strings(keys)
+	signature := strings.Join(keys, ",")
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.ring != nil && b.ring.signature == signature {
+		return b.ring
+	}
+
+	type node struct {
+		hash     uint64
+		endpoint Endpoint
+	}
+	var nodes []node
+	for _, endpoint := range endpoints {
+		for i := 0; i < virtualNodes*weight(endpoint); i++ {
+			nodes = append(nodes, node{hash(endpointKey(endpoint) + "#" + strconv.Itoa(i)), endpoint})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+	ring := &hashRing{signature: signature}
+	for _, n := range nodes {
+		ring.hashes = append(ring.hashes, n.hash)
+		ring.endpoints = append(ring.endpoints, n.endpoint)
+	}
+	b.ring = ring
+	return ring
+}
+
+// hash is fnv-1a followed by the finalizer of murmur3, as fnv alone puts
+// keys which differ in their last characters close to each other.
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,184 @@
+package reproxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEndpoints(weights ...int) []Endpoint {
+	var endpoints []Endpoint
+	for i, w := range weights {
+		endpoints = append(endpoints, Endpoint{IP: fmt.Sprintf("10.0.0.%d", i+1), Weight: w})
+	}
+	return endpoints
+}
+
+// pickCounts picks n times, ending each request right away, and counts the
+// picks per endpoint ip.
+func pickCounts(t *testing.T, b Balancer, endpoints []Endpoint, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		endpoint, done, err := b.Pick(&Request{HttpHeaders: http.Header{}}, endpoints)
+		if !assert.NoError(t, err) {
+			return counts
+		}
+		done()
+		counts[endpoint.IP]++
+	}
+	return counts
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, strategy := range []string{"", "round-robin", "weighted-round-robin", "least-connections", "p2c", "consistent-hash"} {
+		b, err := NewBalancer(LoadBalancer{Strategy: strategy})
+		if assert.NoError(t, err, strategy) {
+			_, _, err = b.Pick(&Request{}, nil)
+			assert.Equal(t, errNoEndpoint, err, strategy)
+		}
+	}
+	_, err := NewBalancer(LoadBalancer{Strategy: "random"})
+	assert.Error(t, err)
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, _ := NewBalancer(LoadBalancer{Strategy: "round-robin"})
+	counts := pickCounts(t, b, testEndpoints(1, 5, 1), 300)
+	assert.Equal(t, map[string]int{"10.0.0.1": 100, "10.0.0.2": 100, "10.0.0.3": 100}, counts)
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	b, _ := NewBalancer(LoadBalancer{Strategy: "weighted-round-robin"})
+	endpoints := testEndpoints(5, 1, 1)
+
+	var picks []string
+	for i := 0; i < 7; i++ {
+		endpoint, _, _ := b.Pick(&Request{}, endpoints)
+		picks = append(picks, endpoint.IP)
+	}
+	// smooth: the heavy endpoint is not picked five times in a row
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.1", "10.0.0.1"}, picks)
+
+	counts := pickCounts(t, b, endpoints, 700)
+	assert.Equal(t, map[string]int{"10.0.0.1": 500, "10.0.0.2": 100, "10.0.0.3": 100}, counts)
+}
+
+func TestLeastConnections(t *testing.T) {
+	b, _ := NewBalancer(LoadBalancer{Strategy: "least-connections"})
+	endpoints := testEndpoints(1, 1, 2)
+
+	// with nothing ended, requests spread by weight
+	dones := make(map[string][]func())
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		endpoint, done, _ := b.Pick(&Request{}, endpoints)
+		dones[endpoint.IP] = append(dones[endpoint.IP], done)
+		counts[endpoint.IP]++
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 2, "10.0.0.2": 2, "10.0.0.3": 4}, counts)
+
+	// an endpoint whose requests ended gets the next one, ending twice
+	// counts once
+	for _, done := range dones["10.0.0.2"] {
+		done()
+		done()
+	}
+	endpoint, _, _ := b.Pick(&Request{}, endpoints)
+	assert.Equal(t, "10.0.0.2", endpoint.IP)
+	endpoint, _, _ = b.Pick(&Request{}, endpoints)
+	assert.Equal(t, "10.0.0.2", endpoint.IP)
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	b, _ := NewBalancer(LoadBalancer{Strategy: "p2c"})
+	endpoints := testEndpoints(1, 1)
+
+	// of two endpoints the one with fewer requests in flight is picked
+	first, done, _ := b.Pick(&Request{}, endpoints)
+	for i := 0; i < 10; i++ {
+		endpoint, done, _ := b.Pick(&Request{}, endpoints)
+		assert.NotEqual(t, first.IP, endpoint.IP)
+		done()
+	}
+	done()
+
+	counts := pickCounts(t, b, testEndpoints(1, 1, 1, 1), 400)
+	assert.Len(t, counts, 4)
+}
+
+func TestConsistentHash(t *testing.T) {
+	request := func(user string) *Request {
+		return &Request{HttpHeaders: http.Header{"X-User": {user}}}
+	}
+	b, _ := NewBalancer(LoadBalancer{Strategy: "consistent-hash", HashHeader: "X-User"})
+	endpoints := testEndpoints(1, 1, 1, 1)
+
+	assigned := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprint("user", i)
+		endpoint, _, _ := b.Pick(request(user), endpoints)
+		again, _, _ := b.Pick(request(user), endpoints)
+		assert.Equal(t, endpoint, again, "key moved without a change of endpoints")
+		assigned[user] = endpoint.IP
+		counts[endpoint.IP]++
+	}
+	for ip, count := range counts {
+		assert.InDelta(t, 250, count, 100, "uneven share of %s", ip)
+	}
+
+	// removing an endpoint only moves the keys it had
+	moved := 0
+	for user, ip := range assigned {
+		endpoint, _, _ := b.Pick(request(user), endpoints[:3])
+		if ip != "10.0.0.4" {
+			assert.Equal(t, ip, endpoint.IP, "key of a remaining endpoint moved")
+		} else {
+			moved++
+		}
+	}
+	assert.Equal(t, counts["10.0.0.4"], moved)
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	endpoints := testEndpoints(1, 1, 1, 1, 1, 1, 1, 1)
+
+	b, _ := NewBalancer(LoadBalancer{Strategy: "consistent-hash", HashCookie: "session"})
+	cookie := func(value string) *Request {
+		return &Request{HttpHeaders: http.Header{"Cookie": {"theme=dark; session=" + value}}}
+	}
+	first, _, _ := b.Pick(cookie("abc"), endpoints)
+	for i := 0; i < 10; i++ {
+		endpoint, _, _ := b.Pick(cookie("abc"), endpoints)
+		assert.Equal(t, first, endpoint)
+	}
+
+	b, _ = NewBalancer(LoadBalancer{Strategy: "consistent-hash"})
+	first, _, _ = b.Pick(&Request{ClientIP: "192.168.0.1"}, endpoints)
+	for i := 0; i < 10; i++ {
+		endpoint, _, _ := b.Pick(&Request{ClientIP: "192.168.0.1"}, endpoints)
+		assert.Equal(t, first, endpoint)
+	}
+
+	// without a key requests are spread in turn
+	counts := pickCounts(t, b, endpoints, 80)
+	assert.Len(t, counts, 8)
+}
+
+func TestEndpointAddr(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:8080", endpointAddr(Endpoint{IP: "10.0.0.1"}, "example.com:8080"))
+	assert.Equal(t, "10.0.0.1:9000", endpointAddr(Endpoint{IP: "10.0.0.1", Port: 9000}, "example.com:8080"))
+	assert.Equal(t, "10.0.0.1", endpointAddr(Endpoint{IP: "10.0.0.1"}, "example.com"))
+	assert.Equal(t, "[::1]:8080", endpointAddr(Endpoint{IP: "::1"}, "example.com:8080"))
+	assert.Equal(t, "[::1]", endpointAddr(Endpoint{IP: "::1"}, "example.com"))
+}
+
+func TestInZone(t *testing.T) {
+	endpoints := []Endpoint{{IP: "10.0.0.1", Zone: "a"}, {IP: "10.0.0.2", Zone: "b"}, {IP: "10.0.0.3", Zone: "a"}}
+	assert.Equal(t, []Endpoint{endpoints[0], endpoints[2]}, inZone(endpoints, "a"))
+	assert.Equal(t, endpoints, inZone(endpoints, "c"))
+	assert.Equal(t, endpoints, inZone(endpoints, ""))
+}
@@ -0,0 +1,460 @@
+package reproxy
+
+import (
+	"bytes"
+	"container/list"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"strings"
+)
+
+const (
+	defaultBreakerWindow    = 10 * time.Second
+	defaultMinRequests      = 20
+	defaultErrorPercent     = 50
+	defaultSlowPercent      = 50
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenRequests = 1
+
+	windowBuckets      = 10
+	maxCachedResponses = 1000
+	maxCachedBodySize  = 1 << 20
+)
+
+type breakerState int
+
+const (
+	closedCircuit breakerState = iota
+	openCircuit
+	halfOpenCircuit
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case openCircuit:
+		return "open"
+	case halfOpenCircuit:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker calls the reverse proxy of a backend while the backend
+// answers well and the fallback of the backend while its circuit is open.
+type circuitBreaker struct {
+	next     ReverseProxy
+	fallback ReverseProxy
+	backend  *Backend
+	config   CircuitBreaker
+	now      func() time.Time
+
+	mtx      sync.Mutex
+	state    breakerState
+	openedAt time.Time
+	window   rollingWindow
+	// trials is the number of requests let through while half-open and
+	// successes the number of them which succeeded
+	trials    int
+	successes int
+
+	cache *responseCache
+}
+
+// NewCircuitBreaker wraps the reverse proxy of backend in the circuit
+// breaker of its config. fallback is the reverse proxy of the fallback
+// backend, if there is one.
+func NewCircuitBreaker(backend *Backend, next ReverseProxy, fallback ReverseProxy) ReverseProxy {
+	config := *backend.CircuitBreaker
+	if config.Window <= 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultMinRequests
+	}
+	if config.ErrorPercent <= 0 {
+		config.ErrorPercent = defaultErrorPercent
+	}
+	if config.SlowPercent <= 0 {
+		config.SlowPercent = defaultSlowPercent
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = defaultOpenTimeout
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	b := &circuitBreaker{
+		next:     next,
+		fallback: fallback,
+		backend:  backend,
+		config:   config,
+		now:      time.Now,
+		window:   rollingWindow{size: config.Window},
+	}
+	if config.Fallback.Cache {
+		b.cache = newResponseCache(maxCachedResponses)
+	}
+	return b
+}
+
+func (b *circuitBreaker) Handle(request *Request) (*Response, error) {
+	trial, allowed := b.allow()
+	if !allowed {
+		return b.fallbackResponse(request)
+	}
+
+	start := b.now()
+	response, err := b.next.Handle(request)
+	if err != nil && request.Context.Err() != nil {
+		// the client gave up, which says nothing about the backend
+		b.release(trial)
+		return response, err
+	}
+	slow := b.config.SlowThreshold > 0 && b.now().Sub(start) > b.config.SlowThreshold
+	failed := err != nil || response == nil || isServerError(response)
+	b.record(trial, failed, slow)
+
+	if !failed && b.cache != nil && isCacheable(request, response) {
+		response.Body = &capturingBody{
+			ReadCloser: response.Body,
+			store: func(body []byte) {
+				b.cache.put(request, response, body)
+			},
+		}
+	}
+	return response, err
+}
+
+// Close closes the reverse proxy of the backend.
+func (b *circuitBreaker) Close() error {
+	if closer, ok := b.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// allow reports whether a request may be sent to the backend and whether it
+// is a trial of a half-open circuit.
+func (b *circuitBreaker) allow() (trial bool, allowed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case openCircuit:
+		if b.now().Sub(b.openedAt) < b.config.OpenTimeout {
+			return false, false
+		}
+		b.setState(halfOpenCircuit)
+		b.trials, b.successes = 0, 0
+		fallthrough
+	case halfOpenCircuit:
+		if b.trials >= b.config.HalfOpenRequests {
+			return false, false
+		}
+		b.trials++
+		return true, true
+	}
+	return false, true
+}
+
+// release gives back the trial of a request whose result is not counted.
+func (b *circuitBreaker) release(trial bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if trial && b.state == halfOpenCircuit {
+		b.trials--
+	}
+}
+
+func (b *circuitBreaker) record(trial bool, failed bool, slow bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+
+	if trial {
+		if b.state != halfOpenCircuit {
+			return
+		}
+		if failed || slow {
+			b.openedAt = now
+			b.setState(openCircuit)
+			return
+		}
+		if b.successes++; b.successes >= b.config.HalfOpenRequests {
+			b.window = rollingWindow{size: b.config.Window}
+			b.setState(closedCircuit)
+		}
+		return
+	}
+	if b.state != closedCircuit {
+		return
+	}
+
+	b.window.add(now, failed, slow)
+	total, failures, slows := b.window.sum(now)
+	if total < b.config.MinRequests {
+		return
+	}
+	if failures*100 >= total*b.config.ErrorPercent ||
+		b.config.SlowThreshold > 0 && slows*100 >= total*b.config.SlowPercent {
+		logrus.WithField("backend", b.backend.Name).Warnf("%d of %d requests failed and %d were slow", failures, total, slows)
+		b.openedAt = now
+		b.setState(openCircuit)
+	}
+}
+
+// setState must be called with mtx held.
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state != state {
+		logrus.WithField("backend", b.backend.Name).Warnf("circuit is %s", state)
+	}
+	b.state = state
+}
+
+func (b *circuitBreaker) fallbackResponse(request *Request) (*Response, error) {
+	fallback := b.config.Fallback
+	if b.cache != nil && isCacheable(request, nil) {
+		if response := b.cache.get(request); response != nil {
+			return response, nil
+		}
+	}
+	if b.fallback != nil {
+		return b.fallback.Handle(request)
+	}
+
+	status := fallback.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	body := fallback.Body
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	headers := make(http.Header)
+	for k, v := range fallback.Headers {
+		headers.Set(k, v)
+	}
+	protocol := "http"
+	if b.backend.Protocol == "grpc" {
+		protocol = "grpc"
+	}
+	return &Response{
+		Protocol:    protocol,
+		HttpStatus:  status,
+		HttpHeaders: headers,
+		Body:        ioutil.NopCloser(bytes.NewBufferString(body)),
+	}, nil
+}
+
+// isServerError reports whether response says the backend failed. grpc
+// calls fail with an http 200 and a grpc status.
+func isServerError(response *Response) bool {
+	if response.HttpStatus >= http.StatusInternalServerError {
+		return true
+	}
+	switch response.HttpHeaders.Get("Grpc-Status") {
+	case strconv.Itoa(grpcDeadlineExceeded), strconv.Itoa(grpcUnavailable):
+		return true
+	}
+	return false
+}
+
+// isCacheable reports whether the response of request may answer the same
+// request of any client later. A nil response only checks the request.
+func isCacheable(request *Request, response *Response) bool {
+	if request.Protocol == "grpc" || request.HttpMethod != "GET" {
+		return false
+	}
+	// the responses of a user are not served to others
+	if request.HttpHeaders.Get("Authorization") != "" || request.HttpHeaders.Get("Cookie") != "" {
+		return false
+	}
+	if response == nil {
+		return true
+	}
+	if response.HttpStatus != http.StatusOK || len(response.HttpHeaders["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, directive := range headerTokens(response.HttpHeaders, "Cache-Control") {
+		if directive == "private" || directive == "no-store" {
+			return false
+		}
+	}
+	for _, name := range headerTokens(response.HttpHeaders, "Vary") {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// headerTokens returns the comma separated tokens of the header name in
+// lower case, without their values.
+func headerTokens(headers http.Header, name string) []string {
+	var tokens []string
+	for _, value := range headers[name] {
+		for _, token := range strings.Split(value, ",") {
+			if i := strings.IndexByte(token, '='); i >= 0 {
+				token = token[:i]
+			}
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// rollingWindow counts the requests of the last size in buckets, so old
+// requests drop out a bucket at a time.
+type rollingWindow struct {
+	size    time.Duration
+	buckets [windowBuckets]windowBucket
+}
+
+type windowBucket struct {
+	epoch    int64
+	total    int
+	failures int
+	slows    int
+}
+
+func (w *rollingWindow) epoch(now time.Time) int64 {
+	width := int64(w.size) / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return now.UnixNano() / width
+}
+
+func (w *rollingWindow) add(now time.Time, failed bool, slow bool) {
+	epoch := w.epoch(now)
+	bucket := &w.buckets[epoch%windowBuckets]
+	if bucket.epoch != epoch {
+		*bucket = windowBucket{epoch: epoch}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slows++
+	}
+}
+
+func (w *rollingWindow) sum(now time.Time) (total, failures, slows int) {
+	epoch := w.epoch(now)
+	for _, bucket := range w.buckets {
+		if bucket.epoch > epoch-windowBuckets && bucket.epoch <= epoch {
+			total += bucket.total
+			failures += bucket.failures
+			slows += bucket.slows
+		}
+	}
+	return
+}
+
+// capturingBody keeps a copy of the body read through it and stores it
+// once the body is read to the end, unless it is too large.
+type capturingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	overflow bool
+	store    func(body []byte)
+}
+
+func (c *capturingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.overflow {
+		if c.buf.Len()+n > maxCachedBodySize {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.overflow && c.store != nil {
+		c.store(c.buf.Bytes())
+		c.store = nil
+	}
+	return n, err
+}
+
+// responseCache holds the last good responses by url, dropping the least
+// recently used ones. A response is only served to requests with the same
+// values of the headers its Vary names.
+type responseCache struct {
+	mtx     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key      string
+	vary     map[string]string
+	protocol string
+	status   int
+	headers  http.Header
+	body     []byte
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *responseCache) put(request *Request, response *Response, body []byte) {
+	key := request.URL
+	vary := make(map[string]string)
+	for _, name := range headerTokens(response.HttpHeaders, "Vary") {
+		vary[name] = strings.Join(request.HttpHeaders[http.CanonicalHeaderKey(name)], ",")
+	}
+	entry := &cachedResponse{
+		key:      key,
+		vary:     vary,
+		protocol: response.Protocol,
+		status:   response.HttpStatus,
+		headers:  cloneHeader(response.HttpHeaders),
+		body:     append([]byte(nil), body...),
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+func (c *responseCache) get(request *Request) *Response {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	element, ok := c.entries[request.URL]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	for name, value := range entry.vary {
+		if strings.Join(request.HttpHeaders[http.CanonicalHeaderKey(name)], ",") != value {
+			return nil
+		}
+	}
+	c.order.MoveToFront(element)
+	return &Response{
+		Protocol:    entry.protocol,
+		HttpStatus:  entry.status,
+		HttpHeaders: cloneHeader(entry.headers),
+		Body:        ioutil.NopCloser(bytes.NewReader(entry.body)),
+	}
+}
@@ -0,0 +1,266 @@
+package reproxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+// handlerFunc is a reverse proxy answering by a func.
+type handlerFunc func(request *Request) (*Response, error)
+
+func (f handlerFunc) Handle(request *Request) (*Response, error) {
+	return f(request)
+}
+
+func textResponse(status int, body string) *Response {
+	return &Response{
+		Protocol:    "http",
+		HttpStatus:  status,
+		HttpHeaders: http.Header{"Content-Type": {"text/plain"}},
+		Body:        ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+// flakyBackend answers with status, or an error when status is 0, and takes
+// delay of the fake clock.
+type flakyBackend struct {
+	status int
+	delay  time.Duration
+	body   string
+	calls  int
+	now    *time.Time
+}
+
+func (f *flakyBackend) Handle(request *Request) (*Response, error) {
+	f.calls++
+	*f.now = f.now.Add(f.delay)
+	if f.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return textResponse(f.status, f.body), nil
+}
+
+func newTestBreaker(config CircuitBreaker, next ReverseProxy, fallback ReverseProxy) (*circuitBreaker, *time.Time) {
+	b := NewCircuitBreaker(&Backend{Name: "test", Protocol: "http", CircuitBreaker: &config}, next, fallback).(*circuitBreaker)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func readResponse(t *testing.T, b ReverseProxy, url string) (int, string) {
+	request := newTestRequest("GET", url)
+	response, err := b.Handle(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	response.Body.Close()
+	return response.HttpStatus, string(body)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	backend := &flakyBackend{status: http.StatusOK, body: "ok"}
+	b, now := newTestBreaker(CircuitBreaker{
+		Window:           10 * time.Second,
+		MinRequests:      4,
+		ErrorPercent:     50,
+		OpenTimeout:      time.Minute,
+		HalfOpenRequests: 2,
+		Fallback:         Fallback{Status: http.StatusServiceUnavailable, Body: "try later", Headers: map[string]string{"Retry-After": "60"}},
+	}, backend, nil)
+	backend.now = now
+
+	for i := 0; i < 3; i++ {
+		readResponse(t, b, "http://gateway/")
+	}
+	// failures out of the window are not counted
+	backend.status = http.StatusInternalServerError
+	*now = now.Add(20 * time.Second)
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, closedCircuit, b.state)
+
+	for i := 0; i < 3; i++ {
+		readResponse(t, b, "http://gateway/")
+	}
+	assert.Equal(t, openCircuit, b.state)
+	calls := backend.calls
+	status, body := readResponse(t, b, "http://gateway/")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "try later", body)
+	assert.Equal(t, calls, backend.calls, "backend was called while the circuit is open")
+
+	// a failed trial opens the circuit again
+	*now = now.Add(time.Minute)
+	status, _ = readResponse(t, b, "http://gateway/")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, openCircuit, b.state)
+
+	// the circuit closes after enough successful trials
+	backend.status = http.StatusOK
+	*now = now.Add(time.Minute)
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, halfOpenCircuit, b.state)
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, closedCircuit, b.state)
+	total, _, _ := b.window.sum(*now)
+	assert.Equal(t, 0, total)
+}
+
+func TestCircuitBreakerHalfOpenLimit(t *testing.T) {
+	b, now := newTestBreaker(CircuitBreaker{MinRequests: 1, OpenTimeout: time.Second}, handlerFunc(func(request *Request) (*Response, error) {
+		return nil, errors.New("connection refused")
+	}), nil)
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, openCircuit, b.state)
+
+	*now = now.Add(time.Second)
+	trial, allowed := b.allow()
+	assert.True(t, trial && allowed)
+	_, allowed = b.allow()
+	assert.False(t, allowed, "more trials than half open requests")
+
+	// a trial the client gave up is given back
+	b.release(true)
+	_, allowed = b.allow()
+	assert.True(t, allowed)
+}
+
+func TestCircuitBreakerSlow(t *testing.T) {
+	backend := &flakyBackend{status: http.StatusOK, delay: 2 * time.Second}
+	b, now := newTestBreaker(CircuitBreaker{MinRequests: 2, SlowThreshold: time.Second, SlowPercent: 100}, backend, nil)
+	backend.now = now
+
+	readResponse(t, b, "http://gateway/")
+	backend.delay = 0
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, closedCircuit, b.state)
+	backend.delay = 2 * time.Second
+	readResponse(t, b, "http://gateway/")
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, closedCircuit, b.state)
+
+	b.window = rollingWindow{size: b.config.Window}
+	readResponse(t, b, "http://gateway/")
+	readResponse(t, b, "http://gateway/")
+	assert.Equal(t, openCircuit, b.state)
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	backend := &flakyBackend{status: http.StatusOK, body: "fresh"}
+	alternate := handlerFunc(func(request *Request) (*Response, error) {
+		return textResponse(http.StatusOK, "alternate"), nil
+	})
+	b, now := newTestBreaker(CircuitBreaker{MinRequests: 1, Fallback: Fallback{Cache: true}}, backend, alternate)
+	backend.now = now
+
+	readResponse(t, b, "http://gateway/cached")
+	request := newTestRequest("POST", "http://gateway/posted")
+	response, _ := b.Handle(request)
+	ioutil.ReadAll(response.Body)
+
+	backend.status = 0
+	for i := 0; i < 3; i++ {
+		readResponse(t, b, "http://gateway/cached")
+	}
+	assert.Equal(t, openCircuit, b.state)
+
+	// the last good response of the url, else the alternate backend
+	status, body := readResponse(t, b, "http://gateway/cached")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "fresh", body)
+	_, body = readResponse(t, b, "http://gateway/posted")
+	assert.Equal(t, "alternate", body)
+	_, body = readResponse(t, b, "http://gateway/other")
+	assert.Equal(t, "alternate", body)
+}
+
+func TestCircuitBreakerFallbackPrivate(t *testing.T) {
+	backend := &flakyBackend{status: http.StatusOK, body: "private"}
+	anonymous := handlerFunc(func(request *Request) (*Response, error) {
+		return textResponse(http.StatusServiceUnavailable, "unavailable"), nil
+	})
+	b, now := newTestBreaker(CircuitBreaker{MinRequests: 1, Fallback: Fallback{Cache: true}}, backend, anonymous)
+	backend.now = now
+
+	get := func(header, value string) string {
+		request := newTestRequest("GET", "http://gateway/account")
+		if header != "" {
+			request.HttpHeaders.Set(header, value)
+		}
+		response, err := b.Handle(request)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return string(body)
+	}
+	get("Authorization", "Bearer alice")
+	get("Cookie", "session=alice")
+
+	backend.status = 0
+	for i := 0; i < 3; i++ {
+		b.Handle(newTestRequest("GET", "http://gateway/account"))
+	}
+	assert.Equal(t, openCircuit, b.state)
+	assert.Equal(t, "unavailable", get("", ""), "authenticated response is served to an anonymous request")
+	assert.Equal(t, "unavailable", get("Authorization", "Bearer bob"))
+}
+
+func TestIsCacheable(t *testing.T) {
+	request := newTestRequest("GET", "http://gateway/")
+	for header, value := range map[string]string{
+		"Cache-Control": "max-age=60, private",
+		"Set-Cookie":    "session=alice",
+		"Vary":          "*",
+	} {
+		response := textResponse(http.StatusOK, "")
+		response.HttpHeaders.Set(header, value)
+		assert.False(t, isCacheable(request, response), "response of %s %s is cacheable", header, value)
+	}
+	response := textResponse(http.StatusOK, "")
+	response.HttpHeaders.Set("Cache-Control", "no-store")
+	assert.False(t, isCacheable(request, response))
+	response.HttpHeaders.Set("Cache-Control", "public, max-age=60")
+	assert.True(t, isCacheable(request, response))
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+	get := func(url string) *Response { return c.get(newTestRequest("GET", url)) }
+	c.put(newTestRequest("GET", "a"), textResponse(http.StatusOK, ""), []byte("a"))
+	c.put(newTestRequest("GET", "b"), textResponse(http.StatusOK, ""), []byte("b"))
+	get("a")
+	c.put(newTestRequest("GET", "c"), textResponse(http.StatusOK, ""), []byte("c"))
+	assert.Nil(t, get("b"), "least recently used response is kept")
+	if response := get("a"); assert.NotNil(t, response) {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "a", string(body))
+	}
+
+	// responses varying by a header are served to requests of the same value
+	varying := textResponse(http.StatusOK, "")
+	varying.HttpHeaders.Set("Vary", "Accept-Language")
+	request := newTestRequest("GET", "d")
+	request.HttpHeaders.Set("Accept-Language", "fr")
+	c.put(request, varying, []byte("bonjour"))
+	assert.NotNil(t, c.get(request))
+	assert.Nil(t, get("d"), "response is served to a request of another language")
+
+	// bodies larger than the limit are not stored
+	stored := false
+	body := &capturingBody{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, maxCachedBodySize+1))),
+		store:      func([]byte) { stored = true },
+	}
+	ioutil.ReadAll(body)
+	assert.False(t, stored)
+}
@@ -0,0 +1,152 @@
+package reproxy
+
+import (
+	"context"
+	"crypto/tls"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// grpc status codes the proxy reports when the backend can not be reached,
+// see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcDeadlineExceeded = 4
+	grpcUnavailable      = 14
+)
+
+var grpcTimeoutUnits = []struct {
+	unit   time.Duration
+	suffix string
+}{
+	{time.Nanosecond, "n"},
+	{time.Microsecond, "u"},
+	{time.Millisecond, "m"},
+	{time.Second, "S"},
+	{time.Minute, "M"},
+	{time.Hour, "H"},
+}
+
+// GrpcReverseProxy forwards grpc calls to a backend over HTTP/2. Unary and
+// streaming calls are proxied the same way: the request and response bodies
+// are streamed and the status arrives in the response trailers.
+type GrpcReverseProxy struct {
+	*HttpReverseProxy
+}
+
+// NewGrpcReverseProxy creates a proxy for a grpc backend. The backend is
+// called in clear text (h2c) unless its scheme is grpcs or https.
+func NewGrpcReverseProxy(serviceDiscovery ServiceDiscovery, backend *Backend) (*GrpcReverseProxy, error) {
+	scheme := "http"
+	if backend.Scheme == "grpcs" || backend.Scheme == "https" {
+		scheme = "https"
+	}
+
+	balancer, err := NewBalancer(backend.LoadBalancer)
+	if err != nil {
+		return nil, err
+	}
+
+	var outliers *outlierDetector
+	if backend.OutlierDetection != nil {
+		outliers = newOutlierDetector(backend)
+	}
+	retry, err := newRetryPolicy(backend)
+	if err != nil {
+		return nil, err
+	}
+	hedge, err := newHedgePolicy(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := hostname(backend.Host)
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := defaultDialer.DialContext(ctx, network, addr)
+			if err != nil || scheme == "http" {
+				return conn, err
+			}
+			// addr is the address of an endpoint, the certificate is the
+			// one of the backend host
+			config = config.Clone()
+			config.ServerName = serverName
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+	return &GrpcReverseProxy{
+		HttpReverseProxy: &HttpReverseProxy{
+			serviceDiscovery: serviceDiscovery,
+			backend:          backend,
+			balancer:         balancer,
+			outliers:         outliers,
+			retry:            retry,
+			hedge:            hedge,
+			transport:        transport,
+			scheme:           scheme,
+			protocol:         "grpc",
+		},
+	}, nil
+}
+
+func (p GrpcReverseProxy) Handle(request *Request) (*Response, error) {
+	logrus.Debug("proxying grpc")
+
+	// The backend gets the time left of the deadline of the client, so it
+	// does not keep working on calls the client gave up on.
+	outRequest := *request
+	outRequest.HttpHeaders = cloneHeader(request.HttpHeaders)
+	if deadline, ok := request.Context.Deadline(); ok {
+		outRequest.HttpHeaders.Set("Grpc-Timeout", encodeGrpcTimeout(time.Until(deadline)))
+	}
+
+	response, err := p.HttpReverseProxy.Handle(&outRequest)
+	if err != nil {
+		// Failed calls are answered with a grpc status instead of an error,
+		// as grpc clients only understand those.
+		code := grpcUnavailable
+		if response != nil && response.HttpStatus == http.StatusGatewayTimeout || request.Context.Err() == context.DeadlineExceeded {
+			code = grpcDeadlineExceeded
+		}
+		return grpcStatus(code, err.Error()), nil
+	}
+	return response, nil
+}
+
+// encodeGrpcTimeout formats d as a grpc-timeout header value in the finest
+// unit which fits in the eight digits allowed.
+func encodeGrpcTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "1n"
+	}
+	for _, u := range grpcTimeoutUnits {
+		if v := (d + u.unit - 1) / u.unit; v < 1e8 {
+			return strconv.FormatInt(int64(v), 10) + u.suffix
+		}
+	}
+	return "99999999H"
+}
+
+// grpcStatus creates a trailers-only grpc response with the status code.
+func grpcStatus(code int, message string) *Response {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/grpc")
+	headers.Set("Grpc-Status", strconv.Itoa(code))
+	headers.Set("Grpc-Message", url.PathEscape(message))
+	return &Response{
+		Protocol:    "grpc",
+		HttpStatus:  http.StatusOK,
+		HttpHeaders: headers,
+	}
+}
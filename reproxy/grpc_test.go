@@ -0,0 +1,168 @@
+package reproxy
+
+import (
+	"context"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/k3rn3l-p4n1c/apigateway/entrypoint"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+const grpcGatewayHost = "127.0.0.1:9551"
+
+// grpcUpstream is an in-process grpc health server which records the
+// metadata and the deadline of the last call it received.
+type grpcUpstream struct {
+	health   *health.Server
+	addr     string
+	metadata chan metadata.MD
+	deadline chan time.Time
+}
+
+func newGrpcUpstream(t *testing.T) (*grpcUpstream, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &grpcUpstream{
+		health:   health.NewServer(),
+		addr:     lis.Addr().String(),
+		metadata: make(chan metadata.MD, 10),
+		deadline: make(chan time.Time, 10),
+	}
+	record := func(ctx context.Context) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		u.metadata <- md
+		deadline, _ := ctx.Deadline()
+		u.deadline <- deadline
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			record(ctx)
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			record(ss.Context())
+			return handler(srv, ss)
+		}),
+	)
+	healthpb.RegisterHealthServer(server, u.health)
+	go server.Serve(lis)
+	return u, server.Stop
+}
+
+func newGrpcGateway(t *testing.T, backendAddr string) (entrypoint.Server, healthpb.HealthClient) {
+	proxy, err := NewGrpcReverseProxy(staticIP("127.0.0.1"), &Backend{
+		Name:     "upstream",
+		Protocol: "grpc",
+		Host:     backendAddr,
+		Scheme:   "grpc",
+		Timeout:  2 * time.Second,
+	})
+	if !assert.NoError(t, err, "error in instantiating grpc reverse proxy") {
+		t.FailNow()
+	}
+	server, err := entrypoint.New(&EntryPoint{Protocol: "grpc", Addr: grpcGatewayHost}, func(request *Request) *Response {
+		response, err := proxy.Handle(request)
+		assert.NoError(t, err, "grpc proxy should answer with a grpc status")
+		return response
+	})
+	if !assert.NoError(t, err, "error in instantiating grpc server") {
+		t.FailNow()
+	}
+	go server.Start()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", grpcGatewayHost); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	conn, err := grpc.NewClient(grpcGatewayHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err, "error in dialing grpc gateway") {
+		t.FailNow()
+	}
+	return server, healthpb.NewHealthClient(conn)
+}
+
+func TestGrpcReverseProxy(t *testing.T) {
+	upstream, stop := newGrpcUpstream(t)
+	defer stop()
+	server, client := newGrpcGateway(t, upstream.addr)
+	defer server.Close()
+
+	t.Run("TestUnary", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant", "acme")
+		deadline, _ := ctx.Deadline()
+
+		response, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if assert.NoError(t, err, "error in proxied unary call") {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.Status)
+			assert.Equal(t, []string{"acme"}, (<-upstream.metadata).Get("x-tenant"), "metadata is not forwarded")
+			upstreamDeadline := <-upstream.deadline
+			assert.False(t, upstreamDeadline.IsZero(), "deadline is not forwarded")
+			assert.WithinDuration(t, deadline, upstreamDeadline, time.Second, "deadline is not forwarded")
+		}
+	})
+
+	t.Run("TestStatus", func(t *testing.T) {
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err), "status of the backend is not forwarded")
+		<-upstream.metadata
+		<-upstream.deadline
+	})
+
+	t.Run("TestStreaming", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if !assert.NoError(t, err, "error in proxied streaming call") {
+			return
+		}
+		response, err := stream.Recv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.Status)
+		}
+		upstream.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		response, err = stream.Recv()
+		if assert.NoError(t, err, "streamed messages are held back") {
+			assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, response.Status)
+		}
+	})
+}
+
+func TestGrpcReverseProxyUnavailable(t *testing.T) {
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := lis.Addr().String()
+	lis.Close()
+	server, client := newGrpcGateway(t, addr)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "unreachable backend should be reported as unavailable")
+}
+
+func TestEncodeGrpcTimeout(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		0:                     "1n",
+		99 * time.Millisecond: "99000000n",
+		5 * time.Second:       "5000000u",
+		3 * time.Hour:         "10800000m",
+	} {
+		assert.Equal(t, expected, encodeGrpcTimeout(d))
+	}
+}
@@ -0,0 +1,242 @@
+package reproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// healthChecker probes the endpoints of a backend in the background and
+// leaves the unhealthy ones out of the endpoints it discovers. Endpoints are
+// healthy until probes say otherwise, so a new endpoint gets traffic right
+// away.
+type healthChecker struct {
+	ServiceDiscovery
+	backend *Backend
+	config  HealthCheck
+	scheme  string
+	client  *http.Client
+
+	mtx    sync.RWMutex
+	states map[string]*endpointHealth
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type endpointHealth struct {
+	unhealthy bool
+	successes int
+	failures  int
+}
+
+func newHealthChecker(discovery ServiceDiscovery, backend *Backend) (*healthChecker, error) {
+	config := *backend.HealthCheck
+	switch config.Type {
+	case "":
+		config.Type = "http"
+	case "http", "tcp":
+	default:
+		return nil, fmt.Errorf("health check type %s is not supported", config.Type)
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		config.Path = "/" + config.Path
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultHealthCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultHealthCheckTimeout
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = defaultHealthyThreshold
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	// grpc backends are probed with plain http requests, over tls for grpcs
+	scheme := httpScheme(backend.Scheme)
+	switch scheme {
+	case "grpc":
+		scheme = "http"
+	case "grpcs":
+		scheme = "https"
+	}
+
+	c := &healthChecker{
+		ServiceDiscovery: discovery,
+		backend:          backend,
+		config:           config,
+		scheme:           scheme,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				DialContext:       defaultDialer.DialContext,
+				TLSClientConfig:   &tls.Config{ServerName: hostname(backend.Host)},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		states: make(map[string]*endpointHealth),
+		stop:   make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Endpoints returns the discovered endpoints which are not unhealthy.
+func (c *healthChecker) Endpoints() ([]Endpoint, error) {
+	endpoints, err := c.ServiceDiscovery.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	healthy := endpoints[:0:0]
+	for _, endpoint := range endpoints {
+		if state := c.states[endpointKey(endpoint)]; state == nil || !state.unhealthy {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return healthy, nil
+}
+
+func (c *healthChecker) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	if closer, ok := c.ServiceDiscovery.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *healthChecker) run() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// checkAll probes all endpoints at once and forgets the endpoints which are
+// not discovered anymore.
+func (c *healthChecker) checkAll() {
+	endpoints, err := c.ServiceDiscovery.Endpoints()
+	if err != nil {
+		logrus.WithError(err).WithField("backend", c.backend.Name).Warn("unable to discover endpoints to health check")
+		return
+	}
+
+	results := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint Endpoint) {
+			defer wg.Done()
+			results[i] = c.probe(endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	discovered := make(map[string]bool, len(endpoints))
+	for i, endpoint := range endpoints {
+		discovered[endpointKey(endpoint)] = true
+		c.record(endpoint, results[i])
+	}
+	for key := range c.states {
+		if !discovered[key] {
+			delete(c.states, key)
+		}
+	}
+}
+
+func (c *healthChecker) probe(endpoint Endpoint) error {
+	addr := endpointAddr(endpoint, c.backend.Host)
+	if c.config.Type == "tcp" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("endpoint %s has no port to health check", addr)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+		defer cancel()
+		conn, err := defaultDialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest("GET", c.scheme+"://"+addr+c.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = c.backend.Host
+	req.Header.Set("User-Agent", "apigateway-health-check")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	if c.config.ExpectedStatus != 0 && res.StatusCode != c.config.ExpectedStatus ||
+		c.config.ExpectedStatus == 0 && (res.StatusCode < 200 || res.StatusCode > 299) {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// record counts the result of a probe and logs when the endpoint becomes
+// healthy or unhealthy. It must be called with mtx held.
+func (c *healthChecker) record(endpoint Endpoint, err error) {
+	key := endpointKey(endpoint)
+	state := c.states[key]
+	if state == nil {
+		state = &endpointHealth{}
+		c.states[key] = state
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"backend":  c.backend.Name,
+		"endpoint": endpointAddr(endpoint, c.backend.Host),
+	})
+
+	if err != nil {
+		state.successes = 0
+		state.failures++
+		if !state.unhealthy && state.failures >= c.config.UnhealthyThreshold {
+			state.unhealthy = true
+			log.WithError(err).Warn("endpoint is unhealthy")
+		}
+		return
+	}
+	state.failures = 0
+	state.successes++
+	if state.unhealthy && state.successes >= c.config.HealthyThreshold {
+		state.unhealthy = false
+		log.Info("endpoint is healthy")
+	}
+}
@@ -0,0 +1,196 @@
+package reproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+// endpointList is a service discovery whose endpoints can be changed.
+type endpointList struct {
+	mtx       sync.Mutex
+	endpoints []Endpoint
+}
+
+func (l *endpointList) Endpoints() ([]Endpoint, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]Endpoint(nil), l.endpoints...), nil
+}
+
+func (l *endpointList) set(endpoints ...Endpoint) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.endpoints = endpoints
+}
+
+func serverEndpoint(t *testing.T, server *httptest.Server) Endpoint {
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+	return Endpoint{IP: host, Port: p, Weight: 1}
+}
+
+func healthyPorts(t *testing.T, c *healthChecker) map[int]bool {
+	endpoints, err := c.Endpoints()
+	assert.NoError(t, err)
+	ports := make(map[int]bool)
+	for _, endpoint := range endpoints {
+		ports[endpoint.Port] = true
+	}
+	return ports
+}
+
+// eventually reports whether condition becomes true within a second.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestHealthChecker(t *testing.T) {
+	var failing int32
+	var host atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		if r.URL.Path != "/healthz" || atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	healthy, unhealthy := serverEndpoint(t, server), serverEndpoint(t, broken)
+	discovery := &endpointList{}
+	discovery.set(healthy, unhealthy)
+	c, err := newHealthChecker(discovery, &Backend{
+		Name:   "test",
+		Host:   "backend.local",
+		Scheme: "http",
+		HealthCheck: &HealthCheck{
+			Path:               "healthz",
+			Interval:           10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.True(t, eventually(func() bool {
+		return len(healthyPorts(t, c)) == 1
+	}))
+	assert.True(t, healthyPorts(t, c)[healthy.Port])
+	assert.Equal(t, "backend.local", host.Load())
+
+	atomic.StoreInt32(&failing, 1)
+	assert.True(t, eventually(func() bool {
+		return len(healthyPorts(t, c)) == 0
+	}))
+
+	atomic.StoreInt32(&failing, 0)
+	assert.True(t, eventually(func() bool {
+		return healthyPorts(t, c)[healthy.Port]
+	}))
+
+	// endpoints which are gone are forgotten
+	discovery.set(healthy)
+	assert.True(t, eventually(func() bool {
+		c.mtx.RLock()
+		defer c.mtx.RUnlock()
+		return len(c.states) == 1
+	}))
+}
+
+func TestHealthCheckerTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	open := listener.Addr().(*net.TCPAddr).Port
+	discovery := &endpointList{}
+	discovery.set(Endpoint{IP: "127.0.0.1", Port: open}, Endpoint{IP: "127.0.0.1", Port: closedPort})
+	c, err := newHealthChecker(discovery, &Backend{
+		Name:        "test",
+		Host:        "backend.local",
+		Protocol:    "grpc",
+		Scheme:      "grpc",
+		HealthCheck: &HealthCheck{Type: "tcp", Interval: 10 * time.Millisecond, UnhealthyThreshold: 1},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.True(t, eventually(func() bool {
+		ports := healthyPorts(t, c)
+		return len(ports) == 1 && ports[open]
+	}))
+}
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	c := &healthChecker{
+		backend: &Backend{Name: "test"},
+		config:  HealthCheck{HealthyThreshold: 2, UnhealthyThreshold: 3},
+		states:  make(map[string]*endpointHealth),
+	}
+	endpoint := Endpoint{IP: "10.0.0.1"}
+	unhealthy := func() bool { return c.states[endpointKey(endpoint)].unhealthy }
+
+	for _, result := range []error{errNoEndpoint, errNoEndpoint, nil, errNoEndpoint, errNoEndpoint} {
+		c.record(endpoint, result)
+		assert.False(t, unhealthy(), "failures in a row are counted only")
+	}
+	c.record(endpoint, errNoEndpoint)
+	assert.True(t, unhealthy())
+	c.record(endpoint, nil)
+	assert.True(t, unhealthy())
+	c.record(endpoint, nil)
+	assert.False(t, unhealthy())
+}
+
+func TestHealthCheckerConfig(t *testing.T) {
+	_, err := newHealthChecker(&endpointList{}, &Backend{HealthCheck: &HealthCheck{Type: "udp"}})
+	assert.Error(t, err)
+
+	c, err := newHealthChecker(&endpointList{}, &Backend{Scheme: "grpcs", HealthCheck: &HealthCheck{}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https", c.scheme)
+		assert.Equal(t, "/", c.config.Path)
+		assert.Equal(t, defaultHealthCheckInterval, c.config.Interval)
+		assert.NoError(t, c.Close())
+		assert.NoError(t, c.Close())
+	}
+}
@@ -0,0 +1,249 @@
+package reproxy
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples    = 1000
+	minLatencySamples = 20
+	// the percentile is computed again after this many new samples
+	latencyRecompute = 50
+)
+
+// hedgeStats counts the hedged requests by backend, in fired and won. They
+// are served on /debug/vars by the metrics entrypoint.
+var hedgeStats = expvar.NewMap("hedges")
+
+type hedgePolicy struct {
+	backend   *Backend
+	config    Hedge
+	latencies *latencies
+	fired     *expvar.Int
+	won       *expvar.Int
+}
+
+// newHedgePolicy returns the hedge policy of backend, or nil if it has none.
+func newHedgePolicy(backend *Backend) (*hedgePolicy, error) {
+	if backend.Hedge == nil {
+		return nil, nil
+	}
+	config := *backend.Hedge
+	if config.Percentile < 0 || config.Percentile >= 100 {
+		return nil, fmt.Errorf("hedge percentile %v is not between 0 and 100", config.Percentile)
+	}
+	if config.Percentile == 0 && config.Delay <= 0 {
+		return nil, errors.New("hedge needs a delay or a percentile")
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultRetryBodySize
+	}
+	stats := new(expvar.Map).Init()
+	hedgeStats.Set(backend.Name, stats)
+	h := &hedgePolicy{
+		backend:   backend,
+		config:    config,
+		latencies: &latencies{},
+		fired:     new(expvar.Int),
+		won:       new(expvar.Int),
+	}
+	stats.Set("fired", h.fired)
+	stats.Set("won", h.won)
+	return h, nil
+}
+
+// applies reports whether request may be hedged.
+func (h *hedgePolicy) applies(request *Request) bool {
+	return upgradeType(request.HttpHeaders) == "" && (h.config.NonIdempotent || isIdempotent(request.HttpMethod))
+}
+
+// delay returns how long the first attempt is waited for before the hedge
+// is sent, or false if no hedge is sent.
+func (h *hedgePolicy) delay() (time.Duration, bool) {
+	if h.config.Percentile > 0 {
+		if d, ok := h.latencies.percentile(h.config.Percentile); ok {
+			return d, true
+		}
+	}
+	return h.config.Delay, h.config.Delay > 0
+}
+
+func (p HttpReverseProxy) handleWithHedge(request *Request) (*Response, error) {
+	replay, body, err := bufferBody(request.Body, p.hedge.config.MaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body. error=%v", err)
+	}
+	if replay == nil {
+		return p.roundTrip(request, body, nil)
+	}
+	return p.hedgedRoundTrip(request, replay, newEndpointSet())
+}
+
+// send makes an attempt of a request whose body can be replayed, hedged if
+// the backend hedges the request.
+func (p HttpReverseProxy) send(request *Request, replay func() io.ReadCloser, tried *endpointSet) (*Response, error) {
+	if p.hedge != nil && p.hedge.applies(request) {
+		return p.hedgedRoundTrip(request, replay, tried)
+	}
+	return p.roundTrip(request, replay(), tried)
+}
+
+type hedgeResult struct {
+	response *Response
+	err      error
+	hedge    bool
+}
+
+// hedgedRoundTrip sends request and, if no response arrives within the
+// hedge delay, sends it again to another endpoint. The first good response
+// is returned and the other attempt is cancelled.
+func (p HttpReverseProxy) hedgedRoundTrip(request *Request, replay func() io.ReadCloser, tried *endpointSet) (*Response, error) {
+	h := p.hedge
+	delay, ok := h.delay()
+	if !ok {
+		return p.timedRoundTrip(request, replay(), tried)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	start := func(hedge bool) {
+		ctx, cancel := context.WithCancel(request.Context)
+		cancels = append(cancels, cancel)
+		attempt := *request
+		attempt.Context = ctx
+		body := replay()
+		go func() {
+			response, err := p.timedRoundTrip(&attempt, body, tried)
+			results <- hedgeResult{response, err, hedge}
+		}()
+	}
+
+	start(false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var result hedgeResult
+	pending := 1
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 {
+				h.fired.Add(1)
+				start(true)
+				pending++
+			}
+			continue
+		case result = <-results:
+			pending--
+		}
+		// a failure before the hedge is due is left to retries, after it the
+		// other attempt may still succeed
+		if result.err == nil && !isServerError(result.response) || pending == 0 {
+			break
+		}
+		closeResponse(result.response)
+	}
+
+	// the attempt of the result lives on with its response body, the other
+	// is cancelled and its response, if any, is dropped
+	for i, cancel := range cancels {
+		if (i == 1) == result.hedge && result.err == nil && result.response.Body != nil {
+			result.response.Body = &cancelOnClose{ReadCloser: result.response.Body, cancel: cancel}
+			continue
+		}
+		cancel()
+	}
+	if pending > 0 {
+		go func() {
+			for ; pending > 0; pending-- {
+				closeResponse((<-results).response)
+			}
+		}()
+	}
+	if result.hedge && result.err == nil {
+		h.won.Add(1)
+	}
+	return result.response, result.err
+}
+
+// timedRoundTrip is roundTrip which counts the latency of the responses.
+func (p HttpReverseProxy) timedRoundTrip(request *Request, body io.ReadCloser, tried *endpointSet) (*Response, error) {
+	start := time.Now()
+	response, err := p.roundTrip(request, body, tried)
+	if err == nil {
+		p.hedge.latencies.add(time.Since(start))
+	}
+	return response, err
+}
+
+func closeResponse(response *Response) {
+	if response != nil && response.Body != nil {
+		response.Body.Close()
+	}
+}
+
+// cancelOnClose cancels the context of a hedged attempt when its response
+// body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// latencies keeps the last response latencies of a backend.
+type latencies struct {
+	mtx     sync.Mutex
+	samples [latencySamples]time.Duration
+	count   int
+	next    int
+	// added counts the samples added since cached was computed
+	added   int
+	cached  time.Duration
+	cachedP float64
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+	if l.count < latencySamples {
+		l.count++
+	}
+	l.added++
+}
+
+// percentile returns the p percentile of the latencies, or false if there
+// are too few of them.
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.count < minLatencySamples {
+		return 0, false
+	}
+	if l.cachedP == p && l.added < latencyRecompute {
+		return l.cached, true
+	}
+	sorted := make([]time.Duration, l.count)
+	copy(sorted, l.samples[:l.count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p / 100 * float64(l.count))
+	if i >= l.count {
+		i = l.count - 1
+	}
+	l.cached, l.cachedP, l.added = sorted[i], p, 0
+	return l.cached, true
+}
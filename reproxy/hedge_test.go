@@ -0,0 +1,177 @@
+package reproxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpReverseProxyHedge(t *testing.T) {
+	var cancelled int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt32(&cancelled, 1)
+		case <-time.After(2 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	discovery := &endpointList{}
+	discovery.set(serverEndpoint(t, slow), serverEndpoint(t, fast))
+	p, err := NewHttpReverseProxy(discovery, &Backend{
+		Name:     "hedged",
+		Protocol: "http",
+		Host:     "backend.local",
+		Scheme:   "http",
+		Timeout:  5 * time.Second,
+		Hedge:    &Hedge{Delay: 20 * time.Millisecond},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer p.Close()
+
+	request := func(method string) (string, time.Duration) {
+		start := time.Now()
+		response, err := p.Handle(newTestRequest(method, "http://gateway/"))
+		if !assert.NoError(t, err) {
+			return "", 0
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body), time.Since(start)
+	}
+
+	// round robin picks the slow endpoint first, and the hedge takes the
+	// next turn
+	for i := 0; i < 2; i++ {
+		body, took := request("GET")
+		assert.Equal(t, "fast", body)
+		assert.True(t, took < time.Second, "request took %s", took)
+	}
+	assert.Equal(t, int64(2), p.hedge.fired.Value())
+	assert.Equal(t, int64(2), p.hedge.won.Value())
+	assert.True(t, eventually(func() bool { return atomic.LoadInt32(&cancelled) == 2 }), "slow requests were not cancelled")
+
+	// not idempotent
+	bodies := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		body, _ := request("POST")
+		bodies[body] = true
+	}
+	assert.Equal(t, map[string]bool{"slow": true, "fast": true}, bodies)
+	assert.Equal(t, int64(2), p.hedge.fired.Value())
+}
+
+// hedgeCounters reads the hedge counters of backend like the metrics
+// entrypoint serves them.
+func hedgeCounters(t *testing.T, backend string) map[string]int64 {
+	recorder := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Hedges map[string]map[string]int64 `json:"hedges"`
+	}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &vars))
+	return vars.Hedges[backend]
+}
+
+func TestHedgeStats(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := 2 * time.Second
+		if r.URL.Path == "/quick" {
+			wait = 60 * time.Millisecond
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(wait):
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(150 * time.Millisecond):
+			w.Write([]byte("hedge"))
+		}
+	}))
+	defer second.Close()
+
+	discovery := &endpointList{}
+	discovery.set(serverEndpoint(t, first), serverEndpoint(t, second))
+	p, err := NewHttpReverseProxy(discovery, &Backend{
+		Name:     "stats",
+		Protocol: "http",
+		Host:     "backend.local",
+		Scheme:   "http",
+		Timeout:  5 * time.Second,
+		Hedge:    &Hedge{Delay: 20 * time.Millisecond},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer p.Close()
+	assert.Equal(t, map[string]int64{"fired": 0, "won": 0}, hedgeCounters(t, "stats"))
+
+	request := func(url string) string {
+		response, err := p.Handle(newTestRequest("GET", url))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body)
+	}
+
+	// the first endpoint answers before the hedge
+	assert.Equal(t, "/quick", request("http://gateway/quick"))
+	assert.Equal(t, map[string]int64{"fired": 1, "won": 0}, hedgeCounters(t, "stats"))
+
+	assert.Equal(t, "hedge", request("http://gateway/"))
+	assert.Equal(t, map[string]int64{"fired": 2, "won": 1}, hedgeCounters(t, "stats"))
+}
+
+func TestHedgePolicy(t *testing.T) {
+	_, err := newHedgePolicy(&Backend{Name: "test", Hedge: &Hedge{}})
+	assert.EqualError(t, err, "hedge needs a delay or a percentile")
+
+	h, err := newHedgePolicy(&Backend{Name: "test", Hedge: &Hedge{Percentile: 90, Delay: time.Second}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the delay until enough latencies are seen
+	for i := 1; i < minLatencySamples; i++ {
+		h.latencies.add(time.Duration(i) * time.Millisecond)
+	}
+	delay, ok := h.delay()
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	for i := minLatencySamples; i <= 100; i++ {
+		h.latencies.add(time.Duration(i) * time.Millisecond)
+	}
+	delay, _ = h.delay()
+	assert.Equal(t, 91*time.Millisecond, delay)
+
+	request := newTestRequest("POST", "http://gateway/")
+	assert.False(t, h.applies(request))
+	request.HttpMethod = "GET"
+	assert.True(t, h.applies(request))
+	request.HttpHeaders.Set("Connection", "Upgrade")
+	request.HttpHeaders.Set("Upgrade", "websocket")
+	assert.False(t, h.applies(request))
+}
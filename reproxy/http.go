@@ -9,11 +9,12 @@ import (
 	"bytes"
 	"io/ioutil"
 	"time"
-	"net/http/httputil"
 	"io"
-	"sync"
 	"net/url"
 	"net"
+	"fmt"
+	"crypto/tls"
+	"sync"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -36,102 +37,199 @@ var defaultDialer = &net.Dialer{
 	DualStack: true,
 }
 
-var getDialFunc = func(serviceDiscovery ServiceDiscovery) func(ctx context.Context, network, addr string) (net.Conn, error) {
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		colon := strings.IndexByte(addr, ':')
-		port := addr[colon+1:]
-		ip, err := serviceDiscovery.Get(addr)
-		if err != nil {
-			return nil, err
-		}
-
-		return defaultDialer.DialContext(ctx, network, ip+":"+port)
-	}
-}
-
 type HttpReverseProxy struct {
 	serviceDiscovery ServiceDiscovery
 	backend          *Backend
-	FlushInterval    time.Duration
-	BufferPool       httputil.BufferPool
+	balancer         Balancer
+	outliers         *outlierDetector
+	retry            *retryPolicy
+	hedge            *hedgePolicy
 	transport        http.RoundTripper
+	// scheme is the url scheme the backend is called with and protocol
+	// the protocol of the responses
+	scheme   string
+	protocol string
 }
 
 func NewHttpReverseProxy(serviceDiscovery ServiceDiscovery, backend *Backend) (*HttpReverseProxy, error) {
+	balancer, err := NewBalancer(backend.LoadBalancer)
+	if err != nil {
+		return nil, err
+	}
 
+	// Requests are sent to the address of an endpoint, so the certificate
+	// of the backend is verified against its host name.
 	transport := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		DialContext:           getDialFunc(serviceDiscovery),
+		DialContext:           defaultDialer.DialContext,
+		TLSClientConfig:       &tls.Config{ServerName: hostname(backend.Host)},
+	}
+	var outliers *outlierDetector
+	if backend.OutlierDetection != nil {
+		outliers = newOutlierDetector(backend)
+	}
+	retry, err := newRetryPolicy(backend)
+	if err != nil {
+		return nil, err
+	}
+	hedge, err := newHedgePolicy(backend)
+	if err != nil {
+		return nil, err
 	}
 	return &HttpReverseProxy{
 		serviceDiscovery: serviceDiscovery,
 		backend:          backend,
+		balancer:         balancer,
+		outliers:         outliers,
+		retry:            retry,
+		hedge:            hedge,
 		transport:        transport,
+		scheme:           httpScheme(backend.Scheme),
+		protocol:         "http",
 	}, nil
 }
 
+// httpScheme returns the http scheme of a websocket backend scheme, as
+// websockets are opened by an http request.
+func httpScheme(scheme string) string {
+	switch scheme {
+	case "ws", "websocket":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	return scheme
+}
+
+// hostname returns host without its port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
 func (p HttpReverseProxy) Handle(request *Request) (*Response, error) {
 	logrus.Debug("proxying http")
+	if p.retry != nil {
+		return p.handleWithRetries(request)
+	}
+	if p.hedge != nil && p.hedge.applies(request) {
+		return p.handleWithHedge(request)
+	}
+	return p.roundTrip(request, request.Body, nil)
+}
 
-	ctx := request.Context
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, p.backend.Timeout)
-	defer cancel()
-	go func() {
-		select {
-		case <-request.Context.Done():
-			cancel()
-		case <-ctx.Done():
-		}
-	}()
+// roundTrip sends request with body to an endpoint of the backend, another
+// than the endpoints in tried if there is one. The endpoint is added to tried.
+func (p HttpReverseProxy) roundTrip(request *Request, body io.ReadCloser, tried *endpointSet) (*Response, error) {
+	// The backend timeout only bounds the wait for the response headers.
+	// Once the backend answers, the body is streamed for as long as the
+	// client keeps the request context alive.
+	ctx, cancel := context.WithCancel(request.Context)
+	timer := time.AfterFunc(p.backend.Timeout, cancel)
 
-	outReq, _ := http.NewRequest(request.HttpMethod, request.URL, request.Body)
+	outReq, err := http.NewRequest(request.HttpMethod, request.URL, body)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
 	outReq = outReq.WithContext(ctx)
 	outReq.Header = cloneHeader(request.HttpHeaders)
-	err := p.director(request, outReq)
+	outReq.Trailer = request.HttpTrailers
+	err = p.director(request, outReq)
 	if err != nil {
 		logrus.WithError(err).Error("unable to direct request")
 	}
 	outReq.Close = false
 
+	endpoint, done, err := p.pick(request, tried)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		logrus.Infof("http: reproxy error: %v", err)
+		return &Response{
+			Protocol:   p.protocol,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(http.StatusText(http.StatusBadGateway))),
+			HttpStatus: http.StatusBadGateway,
+		}, err
+	}
+	outReq.URL.Host = endpointAddr(endpoint, p.backend.Host)
+	tried.add(endpoint)
+
+	reqUpType := upgradeType(outReq.Header)
 	removeConnectionHeaders(outReq.Header)
 
 	// Remove hop-by-hop headers to the backend. Especially
 	// important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.
+	te := outReq.Header["Te"]
 	for _, h := range hopHeaders {
 		if outReq.Header.Get(h) != "" {
 			outReq.Header.Del(h)
 		}
 	}
 
+	// "Te: trailers" is the only TE value the backend must still see; gRPC
+	// servers refuse requests without it.
+	if headerValuesContainToken(te, "trailers") {
+		outReq.Header.Set("Te", "trailers")
+	}
+
+	// An upgrade, e.g. a websocket handshake, is the one case in which the
+	// backend must see the Connection and Upgrade headers of the client.
+	if reqUpType != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", reqUpType)
+	}
+
 	// If we aren't the first proxy retain prior
 	// X-Forwarded-For information as a comma+space
 	// separated list and fold multiple headers into one.
+	clientIP := request.ClientIP
 	if prior, ok := outReq.Header["X-Forwarded-For"]; ok {
-		request.ClientIP = strings.Join(prior, ", ") + ", " + request.ClientIP
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
 	}
-	outReq.Header.Set("X-Forwarded-For", request.ClientIP)
+	outReq.Header.Set("X-Forwarded-For", clientIP)
 
 	res, err := p.transport.RoundTrip(outReq)
+	timedOut := !timer.Stop()
+	if err == nil && timedOut {
+		res.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if p.outliers != nil && request.Context.Err() == nil {
+		// requests the client gave up on say nothing about the endpoint
+		p.outliers.report(endpoint, err != nil || res.StatusCode >= http.StatusInternalServerError)
+	}
 	if err != nil {
-		logrus.Infof("http: reproxy error: %v", err)
-		//request.HttpResponseWriter.WriteHeader(http.StatusBadGateway)
+		cancel()
+		done()
+		logrus.WithField("endpoint", outReq.URL.Host).Infof("http: reproxy error: %v", err)
+		status := http.StatusBadGateway
+		if timedOut {
+			status = http.StatusGatewayTimeout
+		}
 		return &Response{
-			Protocol:   "http",
-			Body:       ioutil.NopCloser(bytes.NewBufferString("bad gateway")),
-			HttpStatus: http.StatusBadGateway,
+			Protocol:   p.protocol,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(http.StatusText(status))),
+			HttpStatus: status,
 		}, err
 	}
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return p.upgradeResponse(reqUpType, res, cancel, done)
+	}
+
 	finalResp := &Response{
-		Protocol:    "http",
+		Protocol:    p.protocol,
 		HttpHeaders: make(http.Header),
-		HttpStatus:  http.StatusBadGateway,
+		HttpStatus:  res.StatusCode,
 	}
 
 	removeConnectionHeaders(res.Header)
@@ -140,59 +238,168 @@ func (p HttpReverseProxy) Handle(request *Request) (*Response, error) {
 		res.Header.Del(h)
 	}
 
-	//copyHeader(request.HttpResponseWriter.Header(), res.Header)
 	copyHeader(finalResp.HttpHeaders, res.Header)
 
-	// The "Trailer" header isn't included in the Transport's response,
-	// at least for *http.Transport. Build it up from Trailer.
-	announcedTrailers := len(res.Trailer)
-	if announcedTrailers > 0 {
-		trailerKeys := make([]string, 0, len(res.Trailer))
-		for k := range res.Trailer {
-			trailerKeys = append(trailerKeys, k)
-		}
-		finalResp.HttpHeaders.Add("Trailer", strings.Join(trailerKeys, ", "))
-		//request.HttpResponseWriter.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	// Trailers are announced by the entrypoint from the keys known now and
+	// their values arrive once the upstream body is read to the end.
+	finalResp.HttpTrailers = res.Trailer
+
+	// Hand the live upstream body to the entrypoint. It is copied to the
+	// client as it arrives and closing it releases the upstream connection.
+	finalResp.Body = &upstreamBody{
+		ReadCloser: res.Body,
+		cancel:     cancel,
+		done:       done,
+		upstream:   res,
+		response:   finalResp,
+	}
+	return finalResp, nil
+}
+
+// upgradeResponse hands the connection the backend switched protocols on
+// to the entrypoint as the body of the response. Reading and writing the
+// body talks to the backend directly.
+func (p HttpReverseProxy) upgradeResponse(reqUpType string, res *http.Response, cancel context.CancelFunc, done func()) (*Response, error) {
+	resUpType := upgradeType(res.Header)
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(reqUpType, resUpType) {
+		res.Body.Close()
+		cancel()
+		done()
+		err := fmt.Errorf("backend switched protocol %q to %q", reqUpType, resUpType)
+		return &Response{
+			Protocol:   p.protocol,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(http.StatusText(http.StatusBadGateway))),
+			HttpStatus: http.StatusBadGateway,
+		}, err
 	}
 
-	//request.HttpResponseWriter.WriteHeader(res.StatusCode)
-	finalResp.HttpStatus = res.StatusCode
-	if len(res.Trailer) > 0 {
-		// Force chunking if we saw a response trailer.
-		// This prevents net/http from calculating the length for short
-		// bodies and adding a Content-Length.
-		panic("WTF?")
-		//if fl, ok := request.HttpResponseWriter.(http.Flusher); ok {
-		//	fl.Flush()
-		//}
+	removeConnectionHeaders(res.Header)
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+	finalResp := &Response{
+		Protocol:    p.protocol,
+		HttpHeaders: make(http.Header),
+		HttpStatus:  res.StatusCode,
+		Body:        &upgradedConn{ReadWriteCloser: conn, cancel: cancel, done: done},
 	}
+	copyHeader(finalResp.HttpHeaders, res.Header)
+	finalResp.HttpHeaders.Set("Connection", "Upgrade")
+	finalResp.HttpHeaders.Set("Upgrade", resUpType)
+	return finalResp, nil
+}
 
-	//p.copyResponse(request.HttpResponseWriter, res.Body)
+// upgradedConn is the connection to a backend which switched protocols.
+// Closing it closes the connection and cancels the outgoing request.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+	done   func()
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		logrus.WithError(err).Debug("error in reading request body")
+func (c *upgradedConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	c.done()
+	return err
+}
+
+// upstreamBody is the streamed body of a backend response. Closing it
+// closes the upstream connection and cancels the outgoing request.
+type upstreamBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	done     func()
+	upstream *http.Response
+	response *Response
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// The transport fills the trailers right before reporting EOF and
+		// replaces the map if none were announced.
+		b.response.HttpTrailers = b.upstream.Trailer
 	}
+	return n, err
+}
 
-	finalResp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	b.done()
+	return err
+}
 
-	res.Body.Close() // close now, instead of defer, to populate res.Trailer
+// Close stops the background work of the service discovery of the proxy,
+// e.g. health checks, and closes its idle connections.
+func (p HttpReverseProxy) Close() error {
+	if t, ok := p.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	if closer, ok := p.serviceDiscovery.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
 
-	if len(res.Trailer) == announcedTrailers {
-		//copyHeader(request.HttpResponseWriter.Header(), res.Trailer)
-		copyHeader(finalResp.HttpHeaders, res.Trailer)
-		return finalResp, nil
+// pick chooses the endpoint of the backend request is sent to, leaving out
+// the endpoints in tried unless no other is left, and the endpoints out of
+// the zone of the gateway while there are endpoints in it.
+func (p HttpReverseProxy) pick(request *Request, tried *endpointSet) (Endpoint, func(), error) {
+	endpoints, err := p.serviceDiscovery.Endpoints()
+	if err != nil {
+		return Endpoint{}, nop, err
+	}
+	if p.outliers != nil {
+		endpoints = p.outliers.filter(endpoints)
+	}
+	if untried := tried.leaveOut(endpoints); len(untried) > 0 {
+		endpoints = untried
+	}
+	endpoints = inZone(endpoints, p.backend.LoadBalancer.Zone)
+	return p.balancer.Pick(request, endpoints)
+}
+
+// endpointSet is the set of endpoints a request was sent to. Hedged
+// attempts of a request share it, so it is safe for concurrent use. A nil
+// set is empty and adding to it does nothing.
+type endpointSet struct {
+	mtx  sync.Mutex
+	keys map[string]bool
+}
+
+func newEndpointSet() *endpointSet {
+	return &endpointSet{keys: make(map[string]bool)}
+}
 
+func (s *endpointSet) add(endpoint Endpoint) {
+	if s == nil {
+		return
 	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys[endpointKey(endpoint)] = true
+}
 
-	for k, vv := range res.Trailer {
-		k = http.TrailerPrefix + k
-		for _, v := range vv {
-			//request.HttpResponseWriter.Header().Add(k, v)
-			finalResp.HttpHeaders.Add(k, v)
+// leaveOut returns the endpoints which are not in the set.
+func (s *endpointSet) leaveOut(endpoints []Endpoint) []Endpoint {
+	if s == nil {
+		return endpoints
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.keys) == 0 {
+		return endpoints
+	}
+	left := endpoints[:0:0]
+	for _, endpoint := range endpoints {
+		if !s.keys[endpointKey(endpoint)] {
+			left = append(left, endpoint)
 		}
 	}
-	return finalResp, nil
+	return left
 }
 
 func cloneHeader(h http.Header) http.Header {
@@ -213,6 +420,28 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
+// headerValuesContainToken reports whether any of values contains token as
+// one of its comma separated elements.
+func headerValuesContainToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeType returns the protocol a request or a response upgrades the
+// connection to, or "" if it is not an upgrade.
+func upgradeType(h http.Header) string {
+	if !headerValuesContainToken(h["Connection"], "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
 // removeConnectionHeaders removes hop-by-hop headers listed in the "Connection" header of h.
 // See RFC 2616, section 14.10.
 func removeConnectionHeaders(h http.Header) {
@@ -230,7 +459,11 @@ func (p HttpReverseProxy) director(incomingReq *Request, outReq *http.Request) e
 	if err != nil {
 		return err
 	}
-	outReq.URL.Scheme = p.backend.Scheme
+	target, err := url.Parse(p.backend.Path)
+	if err != nil {
+		return fmt.Errorf("invalid backend path %s. error=%v", p.backend.Path, err)
+	}
+	outReq.URL.Scheme = p.scheme
 
 	if p.backend.ForwardHost {
 		outReq.URL.Host = incomingUrl.Host
@@ -239,12 +472,12 @@ func (p HttpReverseProxy) director(incomingReq *Request, outReq *http.Request) e
 		outReq.URL.Host = p.backend.Host
 		outReq.Host = p.backend.Host
 	}
-	outReq.URL.Path = singleJoiningSlash(p.backend.Path, outReq.URL.Path)
-	//if request. == "" || outReq.URL.RawQuery == "" {
-	//	outReq.URL.RawQuery = targetQuery + outReq.URL.RawQuery
-	//} else {
-	//	outReq.URL.RawQuery = targetQuery + "&" + outReq.URL.RawQuery
-	//}
+	outReq.URL.Path, outReq.URL.RawPath = joinURLPath(target, outReq.URL)
+	if target.RawQuery == "" || outReq.URL.RawQuery == "" {
+		outReq.URL.RawQuery = target.RawQuery + outReq.URL.RawQuery
+	} else {
+		outReq.URL.RawQuery = target.RawQuery + "&" + outReq.URL.RawQuery
+	}
 	if _, ok := outReq.Header["User-Agent"]; !ok {
 		// explicitly disable User-Agent so it's not set to default value
 		outReq.Header.Set("User-Agent", "")
@@ -252,33 +485,25 @@ func (p HttpReverseProxy) director(incomingReq *Request, outReq *http.Request) e
 	return nil
 }
 
-type writeFlusher interface {
-	io.Writer
-	http.Flusher
-}
-
-func (p HttpReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
-	if p.FlushInterval != 0 {
-		if wf, ok := dst.(writeFlusher); ok {
-			mlw := &maxLatencyWriter{
-				dst:     wf,
-				latency: p.FlushInterval,
-				done:    make(chan bool),
-			}
-			go mlw.flushLoop()
-			defer mlw.stop()
-			dst = mlw
-		}
+// joinURLPath joins the path of the backend and the path of the request,
+// keeping escaped characters like %2F of either as they are.
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
 	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
 
-	var buf []byte
-	if p.BufferPool != nil {
-		buf = p.BufferPool.Get()
-	}
-	p.copyBuffer(dst, src, buf)
-	if p.BufferPool != nil {
-		p.BufferPool.Put(buf)
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
 	}
+	return a.Path + b.Path, apath + bpath
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -292,67 +517,3 @@ func singleJoiningSlash(a, b string) string {
 	}
 	return a + b
 }
-
-type maxLatencyWriter struct {
-	dst     writeFlusher
-	latency time.Duration
-
-	mu   sync.Mutex // protects Write + Flush
-	done chan bool
-}
-
-func (m *maxLatencyWriter) Write(p []byte) (int, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return m.dst.Write(p)
-}
-
-var onExitFlushLoop func()
-
-func (m *maxLatencyWriter) flushLoop() {
-	t := time.NewTicker(m.latency)
-	defer t.Stop()
-	for {
-		select {
-		case <-m.done:
-			if onExitFlushLoop != nil {
-				onExitFlushLoop()
-			}
-			return
-		case <-t.C:
-			m.mu.Lock()
-			m.dst.Flush()
-			m.mu.Unlock()
-		}
-	}
-}
-
-func (m *maxLatencyWriter) stop() { m.done <- true }
-
-func (p *HttpReverseProxy) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
-	if len(buf) == 0 {
-		buf = make([]byte, 32*1024)
-	}
-	var written int64
-	for {
-		nr, rerr := src.Read(buf)
-		if rerr != nil && rerr != io.EOF && rerr != context.Canceled {
-			logrus.Infof("httputil: ReverseProxy read error during body copy: %v", rerr)
-		}
-		if nr > 0 {
-			nw, werr := dst.Write(buf[:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if werr != nil {
-				return written, werr
-			}
-			if nr != nw {
-				return written, io.ErrShortWrite
-			}
-		}
-		if rerr != nil {
-			return written, rerr
-		}
-	}
-}
@@ -10,6 +10,12 @@ import (
 	"bytes"
 	"io/ioutil"
 	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"github.com/k3rn3l-p4n1c/apigateway/entrypoint"
+	"bufio"
+	"net"
 )
 
 func TestHttpReverseProxy(t *testing.T) {
@@ -53,3 +59,289 @@ func TestHttpReverseProxy(t *testing.T) {
 		}
 	}
 }
+
+type staticIP string
+
+func (ip staticIP) Endpoints() ([]Endpoint, error) {
+	return []Endpoint{{IP: string(ip), Weight: 1}}, nil
+}
+
+func newTestProxy(t *testing.T, upstream *httptest.Server) *HttpReverseProxy {
+	u, _ := url.Parse(upstream.URL)
+	p, err := NewHttpReverseProxy(staticIP("127.0.0.1"), &Backend{
+		Name:     "upstream",
+		Protocol: "http",
+		Host:     u.Host,
+		Scheme:   "http",
+		Timeout:  2 * time.Second,
+	})
+	if !assert.NoError(t, err, "error in instantiating reverse proxy") {
+		t.FailNow()
+	}
+	return p
+}
+
+func newTestRequest(method, url string) *Request {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Request{
+		Protocol:    "http",
+		Context:     ctx,
+		CtxCancel:   cancel,
+		ClientIP:    "192.168.0.1",
+		URL:         url,
+		Body:        ioutil.NopCloser(bytes.NewBufferString("")),
+		HttpHeaders: http.Header{},
+		HttpMethod:  method,
+	}
+}
+
+func TestHttpReverseProxyStreamsBody(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	response, err := p.Handle(newTestRequest("GET", "http://gateway/download"))
+	if !assert.NoError(t, err, "error in reverse proxy handle") {
+		return
+	}
+	defer response.Body.Close()
+
+	// Handle returned while the upstream is still blocked, so the body
+	// was not buffered.
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(response.Body, first)
+	if assert.NoError(t, err, "error in reading first chunk") {
+		assert.Equal(t, "first", string(first))
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(response.Body)
+	if assert.NoError(t, err, "error in reading rest of body") {
+		assert.Equal(t, "second", string(rest))
+	}
+}
+
+func TestHttpReverseProxyCloseCancelsUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	response, err := p.Handle(newTestRequest("GET", "http://gateway/poll"))
+	if !assert.NoError(t, err, "error in reverse proxy handle") {
+		return
+	}
+	response.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("closing the response body did not cancel the upstream request")
+	}
+}
+
+func TestHttpReverseProxyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	p := newTestProxy(t, upstream)
+	p.backend.Timeout = 100 * time.Millisecond
+	response, err := p.Handle(newTestRequest("GET", "http://gateway/slow"))
+	assert.Error(t, err, "slow backend should time out")
+	if assert.NotNil(t, response) {
+		assert.Equal(t, http.StatusGatewayTimeout, response.HttpStatus)
+	}
+}
+
+func TestHttpReverseProxyTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Request-Checksum", r.Trailer.Get("X-Request-Checksum"))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "xyz")
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	request := newTestRequest("POST", "http://gateway/upload")
+	request.Body = ioutil.NopCloser(bytes.NewBufferString("payload"))
+	request.HttpTrailers = http.Header{"X-Request-Checksum": {"123"}}
+	request.HttpHeaders.Set("Te", "trailers, deflate")
+
+	response, err := p.Handle(request)
+	if !assert.NoError(t, err, "error in reverse proxy handle") {
+		return
+	}
+	defer response.Body.Close()
+
+	assert.Equal(t, "123", response.HttpHeaders.Get("X-Request-Checksum"), "request trailer is not forwarded")
+	_, announced := response.HttpTrailers["X-Checksum"]
+	assert.True(t, announced, "trailer should be announced before the body is read")
+
+	body, err := ioutil.ReadAll(response.Body)
+	if assert.NoError(t, err, "error in reading body") {
+		assert.Equal(t, "payload", string(body))
+	}
+	assert.Equal(t, "abc", response.HttpTrailers.Get("X-Checksum"))
+	assert.Equal(t, "xyz", response.HttpTrailers.Get("X-Unannounced"))
+}
+
+func TestHttpReverseProxyTrailersEndToEnd(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		w.Write([]byte("data"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	server, err := entrypoint.New(&EntryPoint{Protocol: "http"}, func(request *Request) *Response {
+		response, err := p.Handle(request)
+		assert.NoError(t, err, "error in reverse proxy handle")
+		return response
+	})
+	if !assert.NoError(t, err, "error in instantiating entrypoint") {
+		return
+	}
+	gateway := httptest.NewServer(server.(http.Handler))
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL, nil)
+	req.Header.Set("Te", "trailers")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "error in calling gateway") {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "trailers", res.Header.Get("X-Te"))
+
+	body, err := ioutil.ReadAll(res.Body)
+	if assert.NoError(t, err, "error in reading body") {
+		assert.Equal(t, "data", string(body))
+	}
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+}
+
+// newEchoUpstream returns a backend which switches to the websocket
+// protocol and echoes everything sent on the connection.
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Connection") != "Upgrade" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Upstream: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+func dialWebsocket(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /chat HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, res
+}
+
+func TestHttpReverseProxyWebsocket(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	server, err := entrypoint.New(&EntryPoint{Protocol: "http", IdleTimeout: 200 * time.Millisecond}, func(request *Request) *Response {
+		response, err := p.Handle(request)
+		assert.NoError(t, err, "error in reverse proxy handle")
+		return response
+	})
+	if !assert.NoError(t, err, "error in instantiating entrypoint") {
+		return
+	}
+	gateway := httptest.NewServer(server.(http.Handler))
+	defer gateway.Close()
+	addr := gateway.Listener.Addr().String()
+
+	t.Run("TestEcho", func(t *testing.T) {
+		conn, reader, res := dialWebsocket(t, addr)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+		assert.Equal(t, "websocket", res.Header.Get("Upgrade"))
+		assert.Equal(t, "echo", res.Header.Get("X-Upstream"))
+
+		for _, message := range []string{"ping", "pong"} {
+			conn.Write([]byte(message))
+			buf := make([]byte, len(message))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(reader, buf); assert.NoError(t, err, "error in reading echo") {
+				assert.Equal(t, message, string(buf))
+			}
+		}
+	})
+
+	t.Run("TestIdleTimeout", func(t *testing.T) {
+		conn, reader, res := dialWebsocket(t, addr)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := reader.ReadByte()
+		assert.Equal(t, io.EOF, err, "idle connection should be closed by the gateway")
+	})
+}
+
+func TestHttpReverseProxyDirector(t *testing.T) {
+	for _, test := range []struct {
+		backendPath string
+		url         string
+		expected    string
+	}{
+		{"", "http://gateway/users?page=2", "http://backend:8080/users?page=2"},
+		{"/api/", "http://gateway/users", "http://backend:8080/api/users"},
+		{"/api?key=secret", "http://gateway/users?page=2", "http://backend:8080/api/users?key=secret&page=2"},
+		{"/api?key=secret", "http://gateway/users", "http://backend:8080/api/users?key=secret"},
+		{"/api", "http://gateway/files/a%2Fb", "http://backend:8080/api/files/a%2Fb"},
+	} {
+		p, _ := NewHttpReverseProxy(staticIP("127.0.0.1"), &Backend{
+			Protocol: "http",
+			Scheme:   "http",
+			Host:     "backend:8080",
+			Path:     test.backendPath,
+		})
+		request := newTestRequest("GET", test.url)
+		outReq, _ := http.NewRequest(request.HttpMethod, request.URL, nil)
+		if assert.NoError(t, p.director(request, outReq)) {
+			assert.Equal(t, test.expected, outReq.URL.String(), "wrong url for backend path %q", test.backendPath)
+		}
+	}
+}
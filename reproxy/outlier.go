@@ -0,0 +1,143 @@
+package reproxy
+
+import (
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsecutiveErrors  = 5
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionPercent = 50
+)
+
+// outlierDetector watches the results of the requests to the endpoints of a
+// backend and ejects the endpoints which keep failing.
+type outlierDetector struct {
+	backend *Backend
+	config  OutlierDetection
+	now     func() time.Time
+
+	mtx    sync.Mutex
+	states map[string]*outlierState
+	// total is the number of endpoints last discovered
+	total int
+}
+
+type outlierState struct {
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func newOutlierDetector(backend *Backend) *outlierDetector {
+	config := *backend.OutlierDetection
+	if config.ConsecutiveErrors <= 0 {
+		config.ConsecutiveErrors = defaultConsecutiveErrors
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return &outlierDetector{
+		backend: backend,
+		config:  config,
+		now:     time.Now,
+		states:  make(map[string]*outlierState),
+	}
+}
+
+// filter returns the endpoints which are not ejected. If all of them are,
+// which happens when endpoints are removed, all are returned.
+func (d *outlierDetector) filter(endpoints []Endpoint) []Endpoint {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.total = len(endpoints)
+	if len(d.states) > len(endpoints) {
+		d.forgetRemoved(endpoints)
+	}
+
+	now := d.now()
+	available := endpoints[:0:0]
+	for _, endpoint := range endpoints {
+		if !d.isEjected(endpointKey(endpoint), now) {
+			available = append(available, endpoint)
+		}
+	}
+	if len(available) == 0 {
+		return endpoints
+	}
+	return available
+}
+
+// forgetRemoved drops the state of the endpoints which are not discovered
+// anymore. It must be called with mtx held.
+func (d *outlierDetector) forgetRemoved(endpoints []Endpoint) {
+	discovered := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		discovered[endpointKey(endpoint)] = true
+	}
+	for key := range d.states {
+		if !discovered[key] {
+			delete(d.states, key)
+		}
+	}
+}
+
+// report counts the result of a request to endpoint.
+func (d *outlierDetector) report(endpoint Endpoint, failed bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	key := endpointKey(endpoint)
+	state := d.states[key]
+	if !failed {
+		if state != nil && !d.isEjected(key, d.now()) {
+			delete(d.states, key)
+		}
+		return
+	}
+	if state == nil {
+		state = &outlierState{}
+		d.states[key] = state
+	}
+	now := d.now()
+	if d.isEjected(key, now) {
+		return
+	}
+	state.failures++
+	if state.failures < d.config.ConsecutiveErrors {
+		return
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"backend":  d.backend.Name,
+		"endpoint": endpointAddr(endpoint, d.backend.Host),
+	})
+	ejected := 0
+	for k := range d.states {
+		if d.isEjected(k, now) {
+			ejected++
+		}
+	}
+	if ejected+1 >= d.total || (ejected+1)*100 > d.total*d.config.MaxEjectionPercent {
+		log.Warnf("endpoint failed %d requests in a row, it is not ejected as %d of %d endpoints are ejected",
+			state.failures, ejected, d.total)
+		return
+	}
+	state.ejections++
+	state.failures = 0
+	duration := d.config.BaseEjectionTime * time.Duration(state.ejections)
+	state.ejectedUntil = now.Add(duration)
+	log.Warnf("endpoint is ejected for %s", duration)
+}
+
+// isEjected must be called with mtx held.
+func (d *outlierDetector) isEjected(key string, now time.Time) bool {
+	state := d.states[key]
+	return state != nil && now.Before(state.ejectedUntil)
+}
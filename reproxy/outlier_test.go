@@ -0,0 +1,122 @@
+package reproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDetector(config OutlierDetection) (*outlierDetector, *time.Time) {
+	d := newOutlierDetector(&Backend{Name: "test", OutlierDetection: &config})
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+	return d, &now
+}
+
+func ips(endpoints []Endpoint) []string {
+	var result []string
+	for _, endpoint := range endpoints {
+		result = append(result, endpoint.IP)
+	}
+	return result
+}
+
+func TestOutlierDetector(t *testing.T) {
+	d, now := newTestDetector(OutlierDetection{
+		ConsecutiveErrors:  3,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionPercent: 50,
+	})
+	endpoints := testEndpoints(1, 1, 1, 1)
+	assert.Len(t, d.filter(endpoints), 4)
+
+	// a success in between resets the count
+	for _, failed := range []bool{true, true, false, true, true} {
+		d.report(endpoints[0], failed)
+	}
+	assert.Len(t, d.filter(endpoints), 4)
+
+	d.report(endpoints[0], true)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}, ips(d.filter(endpoints)))
+
+	// back after the ejection time, ejected twice as long the next time
+	*now = now.Add(10 * time.Second)
+	assert.Len(t, d.filter(endpoints), 4)
+	for i := 0; i < 3; i++ {
+		d.report(endpoints[0], true)
+	}
+	*now = now.Add(15 * time.Second)
+	assert.Len(t, d.filter(endpoints), 3)
+	*now = now.Add(5 * time.Second)
+	assert.Len(t, d.filter(endpoints), 4)
+
+	// answering well forgets the ejections
+	d.report(endpoints[0], false)
+	for i := 0; i < 3; i++ {
+		d.report(endpoints[0], true)
+	}
+	*now = now.Add(10 * time.Second)
+	assert.Len(t, d.filter(endpoints), 4)
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	d, _ := newTestDetector(OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 50})
+	endpoints := testEndpoints(1, 1, 1, 1)
+	d.filter(endpoints)
+	for _, endpoint := range endpoints {
+		d.report(endpoint, true)
+	}
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.4"}, ips(d.filter(endpoints)))
+
+	// a backend is never emptied, whatever the percent
+	d, _ = newTestDetector(OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 100})
+	d.filter(endpoints[:1])
+	d.report(endpoints[0], true)
+	assert.Len(t, d.filter(endpoints[:1]), 1)
+
+	// nor when the endpoints left are all ejected
+	d.filter(endpoints[:2])
+	d.report(endpoints[1], true)
+	assert.Equal(t, []string{"10.0.0.1"}, ips(d.filter(endpoints[:2])))
+	assert.Equal(t, []string{"10.0.0.2"}, ips(d.filter(endpoints[1:2])))
+	assert.Len(t, d.states, 1)
+}
+
+func TestHttpReverseProxyOutlierDetection(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	discovery := &endpointList{}
+	discovery.set(serverEndpoint(t, healthy), serverEndpoint(t, failing))
+	p, err := NewHttpReverseProxy(discovery, &Backend{
+		Name:             "upstream",
+		Protocol:         "http",
+		Host:             "backend.local",
+		Scheme:           "http",
+		Timeout:          2 * time.Second,
+		OutlierDetection: &OutlierDetection{ConsecutiveErrors: 2, BaseEjectionTime: time.Minute},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	statuses := make(map[int]int)
+	for i := 0; i < 20; i++ {
+		response, err := p.Handle(newTestRequest("GET", "http://gateway/"))
+		if assert.NoError(t, err) {
+			response.Body.Close()
+			statuses[response.HttpStatus]++
+		}
+	}
+	// round robin sends every other request to the failing endpoint until
+	// it fails twice
+	assert.Equal(t, map[int]int{http.StatusOK: 18, http.StatusBadGateway: 2}, statuses)
+}
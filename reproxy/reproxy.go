@@ -7,14 +7,33 @@ import (
 )
 
 func New(backend *Backend) (ReverseProxy, error) {
+	switch backend.Protocol {
+	case "http", "websocket", "grpc":
+	default:
+		return nil, fmt.Errorf("invalid protocol %s", backend.Protocol)
+	}
 	discovery, err := servicediscovery.New(backend.Discovery)
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize new reverse proxy. error=%v", err)
 	}
-	switch backend.Protocol {
-	case "http":
-		return NewHttpReverseProxy(discovery, backend)
-	default:
-		return nil, fmt.Errorf("invalid protocol %s", backend.Protocol)
+	if backend.HealthCheck != nil {
+		discovery, err = newHealthChecker(discovery, backend)
+		if err != nil {
+			return nil, fmt.Errorf("fail to initialize new reverse proxy. error=%v", err)
+		}
+	}
+
+	var proxy ReverseProxy
+	if backend.Protocol == "grpc" {
+		proxy, err = NewGrpcReverseProxy(discovery, backend)
+	} else {
+		proxy, err = NewHttpReverseProxy(discovery, backend)
+	}
+	if err != nil {
+		if checker, ok := discovery.(*healthChecker); ok {
+			checker.Close()
+		}
+		return nil, err
 	}
+	return proxy, nil
 }
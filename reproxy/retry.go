@@ -0,0 +1,235 @@
+package reproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 2
+	defaultRetryBackoff        = 25 * time.Millisecond
+	defaultMaxRetryBackoff     = 250 * time.Millisecond
+	defaultRetryBodySize       = 64 << 10
+	defaultBudgetPercent       = 20
+	defaultMinRetriesPerSecond = 10
+	retryBudgetWindow          = 10 * time.Second
+)
+
+var retryConditions = map[string]bool{
+	"connect-error": true,
+	"timeout":       true,
+	"502":           true,
+	"503":           true,
+	"504":           true,
+}
+
+var defaultRetryConditions = []string{"connect-error", "502", "503", "504"}
+
+// retryBudget is shared by the backends of the gateway.
+var retryBudget = newBudget(RetryBudget{})
+
+// SetRetryBudget sets the limit of the retries to all backends.
+func SetRetryBudget(config RetryBudget) {
+	retryBudget.configure(config)
+}
+
+type retryPolicy struct {
+	backend *Backend
+	config  Retry
+	on      map[string]bool
+	budget  *budget
+}
+
+// newRetryPolicy returns the retry policy of backend, or nil if it has none.
+func newRetryPolicy(backend *Backend) (*retryPolicy, error) {
+	if backend.Retry == nil {
+		return nil, nil
+	}
+	config := *backend.Retry
+	if len(config.On) == 0 {
+		config.On = defaultRetryConditions
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultRetryAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultRetryBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxRetryBackoff
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultRetryBodySize
+	}
+	on := make(map[string]bool)
+	for _, condition := range config.On {
+		if !retryConditions[condition] {
+			return nil, fmt.Errorf("retry condition %s is not supported", condition)
+		}
+		on[condition] = true
+	}
+	return &retryPolicy{backend: backend, config: config, on: on, budget: retryBudget}, nil
+}
+
+func (p HttpReverseProxy) handleWithRetries(request *Request) (*Response, error) {
+	r := p.retry
+	r.budget.request()
+	if upgradeType(request.HttpHeaders) != "" || !r.config.NonIdempotent && !isIdempotent(request.HttpMethod) {
+		if p.hedge != nil && p.hedge.applies(request) {
+			return p.handleWithHedge(request)
+		}
+		return p.roundTrip(request, request.Body, nil)
+	}
+	replay, body, err := bufferBody(request.Body, r.config.MaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body. error=%v", err)
+	}
+	if replay == nil {
+		return p.roundTrip(request, body, nil)
+	}
+
+	tried := newEndpointSet()
+	for attempt := 1; ; attempt++ {
+		response, err := p.send(request, replay, tried)
+		if attempt >= r.config.MaxAttempts || request.Context.Err() != nil || !r.shouldRetry(response, err) {
+			return response, err
+		}
+		if !r.budget.withdraw() {
+			logrus.WithField("backend", r.backend.Name).Warn("retry budget is exhausted")
+			return response, err
+		}
+		if !sleep(request.Context, r.backoff(attempt)) {
+			return response, err
+		}
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+		logrus.WithField("backend", r.backend.Name).Infof("retrying %s %s, attempt %d failed", request.HttpMethod, request.URL, attempt)
+	}
+}
+
+// shouldRetry reports whether an attempt which ended with response and err
+// fails in a way the policy retries.
+func (r *retryPolicy) shouldRetry(response *Response, err error) bool {
+	switch {
+	case err == nil:
+		return r.on[strconv.Itoa(response.HttpStatus)]
+	case err == errNoEndpoint:
+		return false
+	case response != nil && response.HttpStatus == http.StatusGatewayTimeout:
+		return r.on["timeout"]
+	}
+	return r.on["connect-error"]
+}
+
+// backoff returns a random wait up to the backoff of attempt, so the
+// retries of requests which failed together do not arrive together.
+func (r *retryPolicy) backoff(attempt int) time.Duration {
+	max := r.config.Backoff << uint(attempt-1)
+	if max <= 0 || max > r.config.MaxBackoff {
+		max = r.config.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// sleep waits for d and reports whether ctx is still alive.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// bufferBody reads body up to limit bytes. If it is not larger, replay
+// returns a new reader of the body for each attempt. Otherwise replay is nil
+// and the whole body can still be sent once.
+func bufferBody(body io.ReadCloser, limit int64) (replay func() io.ReadCloser, once io.ReadCloser, err error) {
+	if body == nil {
+		return func() io.ReadCloser { return nil }, nil, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}, nil
+	}
+	body.Close()
+	return func() io.ReadCloser {
+		return ioutil.NopCloser(bytes.NewReader(buf))
+	}, nil, nil
+}
+
+// budget counts the requests and retries of the last ten seconds.
+type budget struct {
+	mtx    sync.Mutex
+	config RetryBudget
+	window rollingWindow
+	now    func() time.Time
+}
+
+func newBudget(config RetryBudget) *budget {
+	b := &budget{window: rollingWindow{size: retryBudgetWindow}, now: time.Now}
+	b.configure(config)
+	return b
+}
+
+func (b *budget) configure(config RetryBudget) {
+	if config.Percent <= 0 {
+		config.Percent = defaultBudgetPercent
+	}
+	if config.MinRetriesPerSecond <= 0 {
+		config.MinRetriesPerSecond = defaultMinRetriesPerSecond
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.config = config
+}
+
+// request counts a request, which adds to the retries allowed.
+func (b *budget) request() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.window.add(b.now(), false, false)
+}
+
+// withdraw counts a retry if the budget allows it.
+func (b *budget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	total, retries, _ := b.window.sum(now)
+	allowed := (total-retries)*b.config.Percent/100 +
+		b.config.MinRetriesPerSecond*int(retryBudgetWindow/time.Second)
+	if retries >= allowed {
+		return false
+	}
+	b.window.add(now, true, false)
+	return true
+}
@@ -0,0 +1,190 @@
+package reproxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetryProxy(t *testing.T, retry *Retry, endpoints ...Endpoint) *HttpReverseProxy {
+	discovery := &endpointList{}
+	discovery.set(endpoints...)
+	p, err := NewHttpReverseProxy(discovery, &Backend{
+		Name:     "upstream",
+		Protocol: "http",
+		Host:     "backend.local",
+		Scheme:   "http",
+		Timeout:  2 * time.Second,
+		Retry:    retry,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	p.retry.budget = newBudget(RetryBudget{})
+	return p
+}
+
+func TestHttpReverseProxyRetry(t *testing.T) {
+	var failed int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer echo.Close()
+
+	request := func(p *HttpReverseProxy, method string, body string) (int, string) {
+		r := newTestRequest(method, "http://gateway/")
+		r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+		response, err := p.Handle(r)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer response.Body.Close()
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return response.HttpStatus, string(responseBody)
+	}
+
+	// the retry goes to the other endpoint with the same body
+	p := newRetryProxy(t, &Retry{}, serverEndpoint(t, failing), serverEndpoint(t, echo))
+	status, body := request(p, "PUT", "payload")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "payload", body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failed))
+
+	// not idempotent
+	p = newRetryProxy(t, &Retry{}, serverEndpoint(t, failing), serverEndpoint(t, echo))
+	status, _ = request(p, "POST", "payload")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	p = newRetryProxy(t, &Retry{NonIdempotent: true}, serverEndpoint(t, failing), serverEndpoint(t, echo))
+	status, _ = request(p, "POST", "payload")
+	assert.Equal(t, http.StatusOK, status)
+
+	// too large to be sent again, but sent whole once
+	p = newRetryProxy(t, &Retry{MaxBodySize: 4}, serverEndpoint(t, echo), serverEndpoint(t, failing))
+	status, body = request(p, "PUT", "payload")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "payload", body)
+	status, _ = request(p, "PUT", "payload")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// the status is not one to retry
+	atomic.StoreInt32(&failed, 0)
+	p = newRetryProxy(t, &Retry{On: []string{"502"}}, serverEndpoint(t, failing), serverEndpoint(t, echo))
+	status, _ = request(p, "GET", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// attempts are limited, the only endpoint is tried again
+	p = newRetryProxy(t, &Retry{MaxAttempts: 3}, serverEndpoint(t, failing))
+	status, _ = request(p, "GET", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&failed))
+}
+
+func TestHttpReverseProxyRetryConnectError(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer echo.Close()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := Endpoint{IP: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port}
+	listener.Close()
+
+	p := newRetryProxy(t, &Retry{}, closed, serverEndpoint(t, echo))
+	response, err := p.Handle(newTestRequest("GET", "http://gateway/"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, response.HttpStatus)
+		response.Body.Close()
+	}
+
+	p = newRetryProxy(t, &Retry{On: []string{"503"}}, closed, serverEndpoint(t, echo))
+	response, err = p.Handle(newTestRequest("GET", "http://gateway/"))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.HttpStatus)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	_, err := newRetryPolicy(&Backend{Retry: &Retry{On: []string{"500"}}})
+	assert.EqualError(t, err, "retry condition 500 is not supported")
+
+	r, err := newRetryPolicy(&Backend{Retry: &Retry{On: []string{"timeout", "504"}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	failure := errors.New("failure")
+	assert.True(t, r.shouldRetry(&Response{HttpStatus: http.StatusGatewayTimeout}, failure))
+	assert.True(t, r.shouldRetry(&Response{HttpStatus: http.StatusGatewayTimeout}, nil))
+	assert.False(t, r.shouldRetry(&Response{HttpStatus: http.StatusBadGateway}, failure))
+	assert.False(t, r.shouldRetry(&Response{HttpStatus: http.StatusBadGateway}, errNoEndpoint))
+
+	for attempt := 1; attempt < 10; attempt++ {
+		max := defaultRetryBackoff << uint(attempt-1)
+		if max > defaultMaxRetryBackoff {
+			max = defaultMaxRetryBackoff
+		}
+		backoff := r.backoff(attempt)
+		assert.True(t, backoff >= 0 && backoff <= max, "backoff %s of attempt %d", backoff, attempt)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newBudget(RetryBudget{Percent: 10, MinRetriesPerSecond: 1})
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+
+	// ten retries a window are allowed without requests
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.withdraw())
+	}
+	assert.False(t, b.withdraw())
+
+	// and one more for each ten requests
+	for i := 0; i < 20; i++ {
+		b.request()
+	}
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	now = now.Add(retryBudgetWindow)
+	assert.True(t, b.withdraw())
+}
+
+func TestBufferBody(t *testing.T) {
+	replay, once, err := bufferBody(ioutil.NopCloser(strings.NewReader("body")), 4)
+	if assert.NoError(t, err) && assert.NotNil(t, replay) {
+		assert.Nil(t, once)
+		for i := 0; i < 2; i++ {
+			body, _ := ioutil.ReadAll(replay())
+			assert.Equal(t, "body", string(body))
+		}
+	}
+
+	replay, once, err = bufferBody(ioutil.NopCloser(strings.NewReader("larger body")), 4)
+	if assert.NoError(t, err) && assert.NotNil(t, once) {
+		assert.Nil(t, replay)
+		body, _ := ioutil.ReadAll(once)
+		assert.Equal(t, "larger body", string(body))
+	}
+
+	replay, _, err = bufferBody(nil, 4)
+	if assert.NoError(t, err) {
+		assert.Nil(t, replay())
+	}
+}
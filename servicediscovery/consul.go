@@ -0,0 +1,296 @@
+package servicediscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsulAddr = "http://127.0.0.1:8500"
+	// consulWait is how long Consul holds a blocking query without changes
+	consulWait       = 5 * time.Minute
+	consulMinBackoff = time.Second
+	consulMaxBackoff = time.Minute
+	// consulTimeout bounds connecting to consul and the first query, which
+	// runs while the config is loaded
+	consulTimeout = 5 * time.Second
+)
+
+// ConsulServiceDiscovery watches the instances of a service in the health
+// api of Consul with blocking queries.
+type ConsulServiceDiscovery struct {
+	config Discovery
+	addr   string
+	query  url.Values
+	token  string
+	client *http.Client
+
+	mtx       sync.RWMutex
+	endpoints []Endpoint
+	index     uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// consulEntry is an instance of a service in the health api.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+func (discovery *ConsulServiceDiscovery) Endpoints() ([]Endpoint, error) {
+	discovery.mtx.RLock()
+	defer discovery.mtx.RUnlock()
+
+	if len(discovery.endpoints) < 1 {
+		return nil, fmt.Errorf("no endpoint discovered for service %s", discovery.config.Service)
+	}
+	endpoints := make([]Endpoint, len(discovery.endpoints))
+	copy(endpoints, discovery.endpoints)
+	return endpoints, nil
+}
+
+// Close stops watching the service.
+func (discovery *ConsulServiceDiscovery) Close() error {
+	discovery.cancel()
+	<-discovery.done
+	return nil
+}
+
+func (discovery *ConsulServiceDiscovery) setConfig(config Discovery) (err error) {
+	if config.Service == "" {
+		return fmt.Errorf("invalid config: no service to discover in consul")
+	}
+	addr := config.Url
+	if addr == "" {
+		addr = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if addr == "" {
+		addr = defaultConsulAddr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return fmt.Errorf("invalid config: %s is not a valid consul address. error=%v", addr, err)
+	}
+
+	discovery.config = config
+	discovery.addr = strings.TrimSuffix(addr, "/") + "/v1/health/service/" + url.PathEscape(config.Service)
+	discovery.query = url.Values{}
+	if config.Datacenter != "" {
+		discovery.query.Set("dc", config.Datacenter)
+	}
+	for _, tag := range config.Tags {
+		discovery.query.Add("tag", tag)
+	}
+	if config.PassingOnly {
+		discovery.query.Set("passing", "1")
+	}
+	discovery.token = os.Getenv("CONSUL_HTTP_TOKEN")
+	// consul adds up to a sixteenth of the wait to spread the responses
+	discovery.client = &http.Client{
+		Timeout: consulWait + consulWait/16 + 10*time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: consulTimeout,
+			DialContext:         (&net.Dialer{Timeout: consulTimeout}).DialContext,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	discovery.cancel = cancel
+	discovery.done = make(chan struct{})
+	// the endpoints stay empty until the watch gets an answer when consul
+	// is slow to answer the first query
+	firstCtx, firstCancel := context.WithTimeout(ctx, consulTimeout)
+	err = discovery.update(firstCtx)
+	firstCancel()
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to discover service %s in consul", config.Service)
+	}
+	go discovery.watch(ctx)
+	return nil
+}
+
+// watch updates the endpoints whenever consul answers a blocking query,
+// until ctx is cancelled. The last endpoints are kept while consul fails.
+func (discovery *ConsulServiceDiscovery) watch(ctx context.Context) {
+	defer close(discovery.done)
+	backoff := consulMinBackoff
+	for ctx.Err() == nil {
+		err := discovery.update(ctx)
+		if err == nil {
+			backoff = consulMinBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Warnf("unable to watch service %s in consul", discovery.config.Service)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > consulMaxBackoff {
+			backoff = consulMaxBackoff
+		}
+	}
+}
+
+// update waits for the instances of the service to change from the last
+// index and keeps them.
+func (discovery *ConsulServiceDiscovery) update(ctx context.Context) error {
+	discovery.mtx.RLock()
+	index := discovery.index
+	discovery.mtx.RUnlock()
+
+	query := url.Values{}
+	for k, v := range discovery.query {
+		query[k] = v
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(consulWait/time.Second)))
+	}
+	request, err := http.NewRequest("GET", discovery.addr+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if discovery.token != "" {
+		request.Header.Set("X-Consul-Token", discovery.token)
+	}
+	response, err := discovery.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("consul responded %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	newIndex, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-Consul-Index. error=%v", err)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("invalid consul response. error=%v", err)
+	}
+	endpoints := discovery.filter(entries)
+
+	discovery.mtx.Lock()
+	defer discovery.mtx.Unlock()
+	switch {
+	case newIndex < index:
+		// the index went back, after a restart of consul, so the next
+		// query starts over
+		newIndex = 0
+	case newIndex < 1:
+		// an index of 0 would not block
+		newIndex = 1
+	}
+	discovery.index = newIndex
+	if len(endpoints) != len(discovery.endpoints) {
+		logrus.Debugf("discovered %d endpoints of service %s", len(endpoints), discovery.config.Service)
+	}
+	discovery.endpoints = endpoints
+	return nil
+}
+
+// filter returns the endpoints of the instances which have all of the tags
+// and are healthy enough.
+func (discovery *ConsulServiceDiscovery) filter(entries []consulEntry) []Endpoint {
+	var endpoints []Endpoint
+	for _, entry := range entries {
+		if !hasTags(entry.Service.Tags, discovery.config.Tags) {
+			continue
+		}
+		weight := entry.Service.Weights.Passing
+		status := checkStatus(entry)
+		switch {
+		case status == "critical" || status == "warning" && discovery.config.PassingOnly:
+			continue
+		case status == "warning":
+			weight = entry.Service.Weights.Warning
+		}
+		if weight <= 0 {
+			weight = 1
+		}
+		ip := entry.Service.Address
+		if ip == "" {
+			ip = entry.Node.Address
+		}
+		endpoints = append(endpoints, Endpoint{
+			IP:     ip,
+			Port:   entry.Service.Port,
+			Weight: weight,
+			Zone:   entry.Service.Meta["zone"],
+		})
+	}
+	return endpoints
+}
+
+// checkStatus returns the worst status of the checks of entry, where
+// maintenance is critical.
+func checkStatus(entry consulEntry) string {
+	status := "passing"
+	for _, check := range entry.Checks {
+		switch check.Status {
+		case "passing":
+		case "warning":
+			if status == "passing" {
+				status = "warning"
+			}
+		default:
+			return "critical"
+		}
+	}
+	return status
+}
+
+func hasTags(tags []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
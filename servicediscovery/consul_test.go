@@ -0,0 +1,216 @@
+package servicediscovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul serves the instances of the web service in the health api of
+// Consul and holds blocking queries until the instances change.
+type fakeConsul struct {
+	mtx       sync.Mutex
+	index     uint64
+	instances []map[string]interface{}
+	changed   chan struct{}
+	queries   chan url.Values
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, changed: make(chan struct{}), queries: make(chan url.Values, 100)}
+}
+
+func (c *fakeConsul) set(instances ...map[string]interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.instances = instances
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" {
+		http.NotFound(w, r)
+		return
+	}
+	c.queries <- r.URL.Query()
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	c.mtx.Lock()
+	for index >= c.index {
+		changed := c.changed
+		c.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		c.mtx.Lock()
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	body, _ := json.Marshal(c.instances)
+	c.mtx.Unlock()
+	w.Write(body)
+}
+
+func instance(address string, port int, tags []string, status ...string) map[string]interface{} {
+	checks := []map[string]string{{"Status": "passing"}}
+	for _, s := range status {
+		checks = append(checks, map[string]string{"Status": s})
+	}
+	return map[string]interface{}{
+		"Node": map[string]string{"Address": "10.0.0.1"},
+		"Service": map[string]interface{}{
+			"Address": address,
+			"Port":    port,
+			"Tags":    tags,
+			"Meta":    map[string]string{"zone": "a"},
+			"Weights": map[string]int{"Passing": 3, "Warning": 1},
+		},
+		"Checks": checks,
+	}
+}
+
+// waitFor waits up to 3s, longer than the shortest refresh of discoveries,
+// for condition to hold.
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestConsulServiceDiscovery(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set(
+		instance("10.0.1.1", 8080, []string{"v1", "primary"}),
+		instance("", 8081, []string{"v1"}),
+		instance("10.0.1.3", 8080, []string{"v2"}),
+		instance("10.0.1.4", 8080, []string{"v1"}, "warning"),
+		instance("10.0.1.5", 8080, []string{"v1"}, "critical"),
+	)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	d, err := New(Discovery{Type: "consul", Url: server.URL, Service: "web", Tags: []string{"v1"}, Datacenter: "dc2"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*ConsulServiceDiscovery).Close()
+
+	query := <-consul.queries
+	assert.Equal(t, "dc2", query.Get("dc"))
+	assert.Equal(t, []string{"v1"}, query["tag"])
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{IP: "10.0.1.1", Port: 8080, Weight: 3, Zone: "a"},
+		{IP: "10.0.0.1", Port: 8081, Weight: 3, Zone: "a"},
+		{IP: "10.0.1.4", Port: 8080, Weight: 1, Zone: "a"},
+	}, endpoints)
+
+	// the next query blocks until the service changes
+	query = <-consul.queries
+	assert.Equal(t, "2", query.Get("index"))
+	consul.set(instance("10.0.1.6", 8080, []string{"v1"}))
+	assert.True(t, waitFor(func() bool {
+		endpoints, _ := d.Endpoints()
+		return len(endpoints) == 1 && endpoints[0].IP == "10.0.1.6"
+	}))
+
+	consul.set()
+	assert.True(t, waitFor(func() bool {
+		_, err := d.Endpoints()
+		return err != nil
+	}))
+}
+
+func TestConsulServiceDiscoveryPassingOnly(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set(
+		instance("10.0.1.1", 8080, nil),
+		instance("10.0.1.2", 8080, nil, "warning"),
+	)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	d, err := New(Discovery{Type: "consul", Url: server.URL, Service: "web", PassingOnly: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	query := <-consul.queries
+	assert.Equal(t, "1", query.Get("passing"))
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{IP: "10.0.1.1", Port: 8080, Weight: 3, Zone: "a"}}, endpoints)
+
+	// close ends the blocking query
+	closed := make(chan struct{})
+	go func() {
+		d.(*ConsulServiceDiscovery).Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("close did not stop the watch")
+	}
+}
+
+func TestConsulServiceDiscoveryUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no cluster leader", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := New(Discovery{Type: "consul", Url: server.URL})
+	assert.EqualError(t, err, "invalid config: no service to discover in consul")
+
+	d, err := New(Discovery{Type: "consul", Url: server.URL, Service: "web"})
+	if assert.NoError(t, err) {
+		defer d.(*ConsulServiceDiscovery).Close()
+		_, err = d.Endpoints()
+		assert.EqualError(t, err, "no endpoint discovered for service web")
+	}
+}
+
+func TestConsulServiceDiscoverySlowFirstQuery(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set(instance("10.0.1.1", 8080, nil))
+	var mtx sync.Mutex
+	hung := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		hang := !hung
+		hung = true
+		mtx.Unlock()
+		if hang {
+			<-r.Context().Done()
+			return
+		}
+		consul.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	d, err := New(Discovery{Type: "consul", Url: server.URL, Service: "web"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*ConsulServiceDiscovery).Close()
+	assert.True(t, time.Since(start) < consulTimeout+time.Second, "the first query is bounded")
+	assert.True(t, waitFor(func() bool {
+		endpoints, err := d.Endpoints()
+		return err == nil && len(endpoints) == 1
+	}), "the watch discovers the endpoints")
+}
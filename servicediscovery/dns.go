@@ -6,67 +6,378 @@ import (
 	"sync"
 	"fmt"
 	"time"
-	"math/rand"
 	"regexp"
 	"github.com/sirupsen/logrus"
+	"context"
+	"strings"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"sort"
+	"io"
+	"math/rand"
 )
 
 var domainRe = regexp.MustCompile(`[a-zA-Z0-9-_]+(\.[a-zA-Z0-9-_])*`)
 
+const (
+	minDNSRefresh     = time.Second
+	maxDNSRefresh     = 5 * time.Minute
+	// defaultDNSRefresh is the refresh of domains resolved by the system,
+	// which does not tell the ttl of the records.
+	defaultDNSRefresh = 30 * time.Second
+	dnsTimeout        = 5 * time.Second
+	resolvConf        = "/etc/resolv.conf"
+)
+
+// DNSServiceDiscovery resolves the endpoints of a domain in the background,
+// again when the records expire. Domains like _http._tcp.example.com are
+// resolved as SRV records, which give the ports and weights of the targets.
+// Other domains are resolved by the system, with its hosts file and search
+// domains, unless a resolver is configured. The last endpoints are served
+// while resolving fails.
 type DNSServiceDiscovery struct {
-	config     Discovery
-	ips        []string
-	lastUpdate time.Time
-	mtx        sync.RWMutex
-}
+	config    Discovery
+	resolvers []string
+	srv       bool
+
+	mtx       sync.RWMutex
+	endpoints []Endpoint
 
-func (discovery *DNSServiceDiscovery) Get(_ string) (ip string, err error) {
-	discovery.resolveDns()
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
+func (discovery *DNSServiceDiscovery) Endpoints() ([]Endpoint, error) {
 	discovery.mtx.RLock()
 	defer discovery.mtx.RUnlock()
 
-	if len(discovery.ips) < 1 {
-		return "", fmt.Errorf("no ip address discoverd for %s", discovery.config.Url)
+	if len(discovery.endpoints) < 1 {
+		return nil, fmt.Errorf("no ip address discoverd for %s", discovery.config.Url)
 	}
-	ip = discovery.ips[rand.Intn(len(discovery.ips))]
-	return ip, nil
+	endpoints := make([]Endpoint, len(discovery.endpoints))
+	copy(endpoints, discovery.endpoints)
+	return endpoints, nil
 }
 
-func (discovery *DNSServiceDiscovery) setConfig(config Discovery) (err error) {
-	if err := func() error {
-		discovery.mtx.Lock()
-		defer discovery.mtx.Unlock()
+// Close stops resolving the domain.
+func (discovery *DNSServiceDiscovery) Close() error {
+	discovery.cancel()
+	<-discovery.done
+	return nil
+}
 
-		if !domainRe.Match([]byte(config.Url)) {
-			return fmt.Errorf("invalid url: %s is not a valid domain", config.Url)
+func (discovery *DNSServiceDiscovery) setConfig(config Discovery) (err error) {
+	if !domainRe.Match([]byte(config.Url)) {
+		return fmt.Errorf("invalid url: %s is not a valid domain", config.Url)
+	}
+	discovery.config = config
+	discovery.srv = strings.HasPrefix(config.Url, "_")
+	discovery.resolvers = nil
+	if config.Resolver != "" {
+		discovery.resolvers = []string{config.Resolver}
+	} else if discovery.srv {
+		discovery.resolvers = systemResolvers()
+	}
+	for i, resolver := range discovery.resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			discovery.resolvers[i] = net.JoinHostPort(resolver, "53")
 		}
-		discovery.config = config
-		discovery.lastUpdate = time.Unix(0,0)
-		return nil
-	}(); err != nil {
-		return err
 	}
 
-	discovery.resolveDns()
+	ctx, cancel := context.WithCancel(context.Background())
+	discovery.cancel = cancel
+	discovery.done = make(chan struct{})
+	refresh, err := discovery.resolveDns(ctx)
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to resolve %s", config.Url)
+		refresh = minDNSRefresh
+	}
+	go discovery.refresh(ctx, refresh)
 	return nil
 }
 
-func (discovery *DNSServiceDiscovery) resolveDns() {
-	if time.Since(discovery.lastUpdate).Seconds() > 10 {
-		discovery.mtx.Lock()
-		defer discovery.mtx.Unlock()
+// refresh resolves the domain again after each wait, until ctx is
+// cancelled. Failures are retried sooner, up to the longest wait.
+func (discovery *DNSServiceDiscovery) refresh(ctx context.Context, wait time.Duration) {
+	defer close(discovery.done)
+	backoff := minDNSRefresh
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		ttl, err := discovery.resolveDns(ctx)
+		if err == nil {
+			wait, backoff = ttl, minDNSRefresh
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Warnf("unable to resolve %s, serving the last endpoints", discovery.config.Url)
+		wait = backoff
+		if backoff *= 2; backoff > maxDNSRefresh {
+			backoff = maxDNSRefresh
+		}
+	}
+}
+
+// resolveDns keeps the endpoints of the domain and returns when they expire.
+func (discovery *DNSServiceDiscovery) resolveDns(ctx context.Context) (time.Duration, error) {
+	var endpoints []Endpoint
+	var ttl uint32
+	var err error
+	if discovery.srv {
+		endpoints, ttl, err = discovery.resolveSrv(ctx, discovery.config.Url)
+	} else {
+		var ips []string
+		if len(discovery.resolvers) == 0 {
+			ips, err = lookupIPs(ctx, discovery.config.Url)
+			ttl = uint32(defaultDNSRefresh / time.Second)
+		} else {
+			ips, ttl, err = discovery.resolveIPs(ctx, discovery.config.Url, nil)
+		}
+		for _, ip := range ips {
+			endpoints = append(endpoints, Endpoint{IP: ip, Weight: 1})
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(endpoints) == 0 {
+		return 0, fmt.Errorf("no record of %s", discovery.config.Url)
+	}
+	logrus.Debugf("resolve %d endpoints for %s", len(endpoints), discovery.config.Url)
+
+	discovery.mtx.Lock()
+	discovery.endpoints = endpoints
+	discovery.mtx.Unlock()
+
+	refresh := time.Duration(ttl) * time.Second
+	if refresh < minDNSRefresh {
+		refresh = minDNSRefresh
+	}
+	if refresh > maxDNSRefresh {
+		refresh = maxDNSRefresh
+	}
+	return refresh, nil
+}
+
+// resolveSrv returns the targets of the lowest priority of the SRV records
+// of name, and the shortest ttl of the records.
+func (discovery *DNSServiceDiscovery) resolveSrv(ctx context.Context, name string) ([]Endpoint, uint32, error) {
+	answers, additionals, err := discovery.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []*dnsmessage.SRVResource
+	ttl := uint32(maxDNSRefresh / time.Second)
+	for _, answer := range answers {
+		if srv, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, srv)
+			ttl = minTTL(ttl, answer.Header.TTL)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+
+	var endpoints []Endpoint
+	for _, srv := range records {
+		if srv.Priority != records[0].Priority {
+			break
+		}
+		ips, targetTTL, err := discovery.resolveIPs(ctx, srv.Target.String(), additionals)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, targetTTL)
+		weight := int(srv.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		for _, ip := range ips {
+			endpoints = append(endpoints, Endpoint{IP: ip, Port: int(srv.Port), Weight: weight})
+		}
+	}
+	return endpoints, ttl, nil
+}
+
+// resolveIPs returns the addresses of name, from the additional records of
+// an SRV response if they have them, and the shortest ttl of the records.
+func (discovery *DNSServiceDiscovery) resolveIPs(ctx context.Context, name string, additionals []dnsmessage.Resource) ([]string, uint32, error) {
+	if ips, ttl := addresses(name, additionals); len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	var ips []string
+	ttl := uint32(maxDNSRefresh / time.Second)
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, _, err := discovery.query(ctx, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found, answersTTL := addresses("", answers)
+		ips = append(ips, found...)
+		ttl = minTTL(ttl, answersTTL)
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// lookupIPs returns the addresses of name resolved by the system.
+func lookupIPs(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP.String()
+	}
+	return ips, nil
+}
 
-		if ips, err := net.LookupIP(discovery.config.Url); err == nil {
-			logrus.Debugf("resolve %d ip for %s", len(ips), discovery.config.Url)
+// addresses returns the A and AAAA records of name in records, of any name
+// if name is empty, and their shortest ttl.
+func addresses(name string, records []dnsmessage.Resource) ([]string, uint32) {
+	var ips []string
+	ttl := uint32(maxDNSRefresh / time.Second)
+	for _, record := range records {
+		if name != "" && !strings.EqualFold(record.Header.Name.String(), fqdn(name)) {
+			continue
+		}
+		switch body := record.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		default:
+			continue
+		}
+		ttl = minTTL(ttl, record.Header.TTL)
+	}
+	return ips, ttl
+}
 
-			discovery.ips = make([]string, len(ips))
-			for i, ip := range ips {
-				discovery.ips[i] = ip.String()
+// query asks the resolvers in turn for the records of name, until one of
+// them answers.
+func (discovery *DNSServiceDiscovery) query(ctx context.Context, name string, qtype dnsmessage.Type) (answers []dnsmessage.Resource, additionals []dnsmessage.Resource, err error) {
+	err = fmt.Errorf("no resolver for %s", name)
+	for _, resolver := range discovery.resolvers {
+		answers, additionals, err = queryResolver(ctx, resolver, name, qtype)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return answers, additionals, err
+}
+
+// queryResolver asks resolver for the records of name over udp, and over tcp
+// if the response is truncated.
+func queryResolver(ctx context.Context, resolver string, name string, qtype dnsmessage.Type) (answers []dnsmessage.Resource, additionals []dnsmessage.Resource, err error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid domain %s. error=%v", name, err)
+	}
+	id := uint16(rand.Intn(1 << 16))
+	request := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	response, err := exchange(ctx, "udp", resolver, packed)
+	if err == nil && response.Header.Truncated {
+		response, err = exchange(ctx, "tcp", resolver, packed)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Header.ID != id {
+		return nil, nil, fmt.Errorf("dns response of %s does not match the query", name)
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, nil, fmt.Errorf("dns query of %s %s failed: %s", qtype, name, response.Header.RCode)
+	}
+	return response.Answers, response.Additionals, nil
+}
+
+func exchange(ctx context.Context, network string, resolver string, packed []byte) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// messages over tcp are prefixed by their length
+		if _, err := conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n, err = io.ReadFull(conn, buf[:int(buf[0])<<8|int(buf[1])])
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		n, err = conn.Read(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		return nil, fmt.Errorf("invalid dns response. error=%v", err)
+	}
+	return &response, nil
+}
+
+// systemResolvers returns the name servers of resolv.conf.
+func systemResolvers() []string {
+	var resolvers []string
+	content, err := ioutil.ReadFile(resolvConf)
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				resolvers = append(resolvers, fields[1])
 			}
-			discovery.lastUpdate = time.Now()
-		} else {
-			logrus.Debugf("unable to resolve ip for %s", discovery.config.Url)
 		}
 	}
+	if len(resolvers) == 0 {
+		return []string{"127.0.0.1"}
+	}
+	return resolvers
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func minTTL(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
 }
@@ -5,6 +5,12 @@ import (
 	. "github.com/k3rn3l-p4n1c/apigateway"
 	"github.com/stretchr/testify/assert"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sync"
+	"errors"
+	"syscall"
 )
 
 func TestDiscoverByDomain(t *testing.T) {
@@ -16,11 +22,210 @@ func TestDiscoverByDomain(t *testing.T) {
 	amazonIps := []string{"176.32.98.166", "176.32.103.205","205.251.242.103"}
 
 	if d,err := New(config); assert.NoError(t, err, "fail to create new service discovery") {
-		ip, err := d.Get("")
+		endpoints, err := d.Endpoints()
 		if assert.NoError(t, err, "error in getting ip") {
-			assert.Contains(t, amazonIps, ip, "resolved ip is not in amazon ips")
+			for _, endpoint := range endpoints {
+				assert.Contains(t, amazonIps, endpoint.IP, "resolved ip is not in amazon ips")
+			}
 		}
 	}
 
 
-}
\ No newline at end of file
+}
+
+func TestDNSServiceDiscoveryHosts(t *testing.T) {
+	// localhost is in the hosts file and resolved without a name server
+	d, err := New(Discovery{Type: "dns", Url: "localhost"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*DNSServiceDiscovery).Close()
+	endpoints, err := d.Endpoints()
+	if assert.NoError(t, err) && assert.NotEmpty(t, endpoints) {
+		for _, endpoint := range endpoints {
+			assert.True(t, net.ParseIP(endpoint.IP).IsLoopback(), "%s is not a loopback address", endpoint.IP)
+		}
+	}
+}
+
+// fakeDNS answers the queries of its records over udp and tcp, or fails
+// them with a server failure.
+type fakeDNS struct {
+	mtx      sync.Mutex
+	records  map[dnsmessage.Type][]dnsmessage.Resource
+	fail     bool
+	failed   int
+	truncate bool
+	udp      net.PacketConn
+	tcp      net.Listener
+}
+
+// listenDNS listens on the same port over tcp and udp, on another port if
+// the udp port of the tcp listener is in use.
+func listenDNS(t *testing.T) (net.PacketConn, net.Listener) {
+	for i := 0; ; i++ {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		udp, err := net.ListenPacket("udp", tcp.Addr().String())
+		if err == nil {
+			return udp, tcp
+		}
+		tcp.Close()
+		if !errors.Is(err, syscall.EADDRINUSE) || i == 10 {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	udp, tcp := listenDNS(t)
+	d := &fakeDNS{records: map[dnsmessage.Type][]dnsmessage.Resource{}, udp: udp, tcp: tcp}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(d.answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 2)
+			io.ReadFull(conn, buf)
+			buf = make([]byte, int(buf[0])<<8|int(buf[1]))
+			io.ReadFull(conn, buf)
+			response := d.answer(buf, false)
+			conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+			conn.Close()
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) Close() {
+	d.udp.Close()
+	d.tcp.Close()
+}
+
+func (d *fakeDNS) set(records ...dnsmessage.Resource) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.records = map[dnsmessage.Type][]dnsmessage.Resource{}
+	for _, record := range records {
+		d.records[record.Header.Type] = append(d.records[record.Header.Type], record)
+	}
+}
+
+func (d *fakeDNS) answer(query []byte, udp bool) []byte {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var request dnsmessage.Message
+	request.Unpack(query)
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: request.Header.ID, Response: true},
+		Questions: request.Questions,
+	}
+	switch {
+	case d.fail:
+		d.failed++
+		response.Header.RCode = dnsmessage.RCodeServerFailure
+	case d.truncate && udp:
+		response.Header.Truncated = true
+	default:
+		for _, record := range d.records[request.Questions[0].Type] {
+			if record.Header.Name == request.Questions[0].Name {
+				response.Answers = append(response.Answers, record)
+			}
+		}
+		if request.Questions[0].Type == dnsmessage.TypeSRV {
+			response.Additionals = d.records[dnsmessage.TypeA]
+		}
+	}
+	packed, _ := response.Pack()
+	return packed
+}
+
+func header(name string, ttl uint32, rtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func aRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: header(name, ttl, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: a}}
+}
+
+func srvRecord(name string, ttl uint32, priority, weight, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, ttl, dnsmessage.TypeSRV),
+		Body:   &dnsmessage.SRVResource{Priority: priority, Weight: weight, Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestDNSServiceDiscovery(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	server.set(aRecord("web.local.", 1, "10.0.0.1"), aRecord("web.local.", 1, "10.0.0.2"))
+
+	d, err := New(Discovery{Type: "dns", Url: "web.local", Resolver: server.udp.LocalAddr().String()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*DNSServiceDiscovery).Close()
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{IP: "10.0.0.1", Weight: 1}, {IP: "10.0.0.2", Weight: 1}}, endpoints)
+
+	// resolved again when the records expire
+	server.set(aRecord("web.local.", 1, "10.0.0.3"))
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.3"}, ips(d)) }))
+
+	// the last endpoints are served while the resolver fails
+	server.mtx.Lock()
+	server.fail = true
+	server.mtx.Unlock()
+	server.set(aRecord("web.local.", 1, "10.0.0.4"))
+	// the second failure is asked after the first one is handled
+	assert.True(t, waitFor(func() bool {
+		server.mtx.Lock()
+		defer server.mtx.Unlock()
+		return server.failed >= 2
+	}))
+	assert.Equal(t, []string{"10.0.0.3"}, ips(d))
+}
+
+func TestDNSServiceDiscoverySrv(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	server.set(
+		srvRecord("_http._tcp.web.local.", 60, 10, 3, 8080, "a.web.local."),
+		srvRecord("_http._tcp.web.local.", 60, 10, 1, 8081, "b.web.local."),
+		srvRecord("_http._tcp.web.local.", 60, 20, 1, 8080, "backup.web.local."),
+		aRecord("a.web.local.", 60, "10.0.0.1"),
+		aRecord("b.web.local.", 60, "10.0.0.2"),
+	)
+	// the responses are truncated over udp
+	server.mtx.Lock()
+	server.truncate = true
+	server.mtx.Unlock()
+
+	d, err := New(Discovery{Type: "dns", Url: "_http._tcp.web.local", Resolver: server.udp.LocalAddr().String()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*DNSServiceDiscovery).Close()
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{IP: "10.0.0.1", Port: 8080, Weight: 3},
+		{IP: "10.0.0.2", Port: 8081, Weight: 1},
+	}, endpoints)
+}
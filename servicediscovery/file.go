@@ -0,0 +1,217 @@
+package servicediscovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileReloadDelay gathers the events of a file being written into one
+// reload.
+const fileReloadDelay = 100 * time.Millisecond
+
+// FileServiceDiscovery reads the endpoints of a backend from a file, or the
+// files of a directory, and reads them again when they change. The last
+// endpoints are kept while a file is invalid.
+type FileServiceDiscovery struct {
+	config  Discovery
+	path    string
+	dir     bool
+	watcher *fsnotify.Watcher
+
+	mtx       sync.RWMutex
+	endpoints []Endpoint
+
+	done chan struct{}
+}
+
+// fileEndpoint is an endpoint in a file.
+type fileEndpoint struct {
+	IP       string            `json:"ip" yaml:"ip"`
+	Port     int               `json:"port" yaml:"port"`
+	Weight   int               `json:"weight" yaml:"weight"`
+	Zone     string            `json:"zone" yaml:"zone"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+func (discovery *FileServiceDiscovery) Endpoints() ([]Endpoint, error) {
+	discovery.mtx.RLock()
+	defer discovery.mtx.RUnlock()
+
+	if len(discovery.endpoints) < 1 {
+		return nil, fmt.Errorf("no endpoint discovered in %s", discovery.path)
+	}
+	endpoints := make([]Endpoint, len(discovery.endpoints))
+	copy(endpoints, discovery.endpoints)
+	return endpoints, nil
+}
+
+// Close stops watching the files.
+func (discovery *FileServiceDiscovery) Close() error {
+	err := discovery.watcher.Close()
+	<-discovery.done
+	return err
+}
+
+func (discovery *FileServiceDiscovery) setConfig(config Discovery) (err error) {
+	if config.Path == "" {
+		return fmt.Errorf("invalid config: no path of the endpoints file")
+	}
+	path := filepath.Clean(config.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("invalid config: unable to read %s. error=%v", path, err)
+	}
+	discovery.config = config
+	discovery.path = path
+	discovery.dir = info.IsDir()
+	if err := discovery.load(); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to watch %s. error=%v", path, err)
+	}
+	// the directory of a file is watched, so a file replaced by a rename
+	// is noticed too
+	dir := path
+	if !discovery.dir {
+		dir = filepath.Dir(path)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("unable to watch %s. error=%v", path, err)
+	}
+	discovery.watcher = watcher
+	discovery.done = make(chan struct{})
+	go discovery.watch()
+	return nil
+}
+
+func (discovery *FileServiceDiscovery) watch() {
+	defer close(discovery.done)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-discovery.watcher.Events:
+			if !ok {
+				return
+			}
+			if !discovery.watched(event.Name) {
+				continue
+			}
+			if reload == nil {
+				reload = time.After(fileReloadDelay)
+			}
+		case err, ok := <-discovery.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Errorf("error in watching %s", discovery.path)
+		case <-reload:
+			reload = nil
+			if err := discovery.load(); err != nil {
+				logrus.WithError(err).Errorf("unable to read endpoints, serving the last endpoints")
+			}
+		}
+	}
+}
+
+// watched reports whether the file of an event holds endpoints.
+func (discovery *FileServiceDiscovery) watched(name string) bool {
+	name = filepath.Clean(name)
+	if !discovery.dir {
+		return name == discovery.path
+	}
+	return filepath.Dir(name) == discovery.path && isEndpointsFile(filepath.Base(name))
+}
+
+// load reads the endpoints of the file or of the files of the directory.
+func (discovery *FileServiceDiscovery) load() error {
+	files := []string{discovery.path}
+	if discovery.dir {
+		infos, err := ioutil.ReadDir(discovery.path)
+		if err != nil {
+			return fmt.Errorf("unable to read %s. error=%v", discovery.path, err)
+		}
+		files = nil
+		for _, info := range infos {
+			if !info.IsDir() && isEndpointsFile(info.Name()) {
+				files = append(files, filepath.Join(discovery.path, info.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var endpoints []Endpoint
+	for _, file := range files {
+		fileEndpoints, err := readEndpoints(file)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, fileEndpoints...)
+	}
+	logrus.Debugf("read %d endpoints in %s", len(endpoints), discovery.path)
+
+	discovery.mtx.Lock()
+	defer discovery.mtx.Unlock()
+	discovery.endpoints = endpoints
+	return nil
+}
+
+// readEndpoints reads a list of endpoints in json, if the name of file ends
+// with .json, else in yaml.
+func readEndpoints(file string) ([]Endpoint, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s. error=%v", file, err)
+	}
+	var list []fileEndpoint
+	if strings.HasSuffix(file, ".json") {
+		err = json.Unmarshal(content, &list)
+	} else {
+		err = yaml.Unmarshal(content, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoints in %s. error=%v", file, err)
+	}
+
+	endpoints := make([]Endpoint, len(list))
+	for i, e := range list {
+		if e.IP == "" {
+			return nil, fmt.Errorf("invalid endpoints in %s: endpoint %d has no ip", file, i+1)
+		}
+		if e.Port < 0 || e.Port > 65535 || e.Weight < 0 {
+			return nil, fmt.Errorf("invalid endpoints in %s: endpoint %s has an invalid port or weight", file, e.IP)
+		}
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+		endpoints[i] = Endpoint{IP: e.IP, Port: e.Port, Weight: e.Weight, Zone: e.Zone, Metadata: e.Metadata}
+	}
+	return endpoints, nil
+}
+
+// isEndpointsFile reports whether a file in a directory holds endpoints.
+// Hidden files, which editors and tools write before renaming them, do not.
+func isEndpointsFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".json", ".yml", ".yaml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package servicediscovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileServiceDiscovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "endpoints")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "web.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+- ip: 10.0.0.1
+  port: 8080
+  weight: 2
+  zone: a
+  metadata: {rack: r1}
+- ip: 10.0.0.2
+`), 0644))
+
+	d, err := New(Discovery{Type: "file", Path: path})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*FileServiceDiscovery).Close()
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{IP: "10.0.0.1", Port: 8080, Weight: 2, Zone: "a", Metadata: map[string]string{"rack": "r1"}},
+		{IP: "10.0.0.2", Weight: 1},
+	}, endpoints)
+
+	// a file replaced by a rename, as ansible writes files
+	tmp := filepath.Join(dir, ".web.yml.tmp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte(`[{ip: 10.0.0.3}]`), 0644))
+	assert.NoError(t, os.Rename(tmp, path))
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.3"}, ips(d)) }))
+
+	// the last endpoints are kept while the file is invalid
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`[{port: 80}]`), 0644))
+	time.Sleep(3 * fileReloadDelay)
+	assert.Equal(t, []string{"10.0.0.3"}, ips(d))
+}
+
+func TestFileServiceDiscoveryDirectory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "endpoints")
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`[{"ip": "10.0.0.2", "port": 8080}]`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`[{ip: 10.0.0.1}]`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte(`endpoints of web`), 0644))
+
+	d, err := New(Discovery{Type: "file", Path: dir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*FileServiceDiscovery).Close()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(d))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "c.yml"), []byte(`[{ip: 10.0.0.3}]`), 0644))
+	assert.True(t, waitFor(func() bool { return len(ips(d)) == 3 }))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "a.yaml")))
+	assert.True(t, waitFor(func() bool {
+		return assert.ObjectsAreEqual([]string{"10.0.0.2", "10.0.0.3"}, ips(d))
+	}))
+
+	_, err = New(Discovery{Type: "file", Path: filepath.Join(dir, "missing.yml")})
+	assert.Error(t, err)
+}
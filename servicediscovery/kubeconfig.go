@@ -0,0 +1,230 @@
+package servicediscovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesTimeout = 10 * time.Second
+)
+
+// kubernetesClient calls the api server of a cluster as the service account
+// of the gateway or the user of a kubeconfig.
+type kubernetesClient struct {
+	server    string
+	namespace string
+	token     string
+	tokenFile string
+	username  string
+	password  string
+	client    *http.Client
+}
+
+// kubeconfig is the part of a kubeconfig file the gateway understands.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+	Clusters []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Username              string
+			Password              string
+			Exec                  interface{}
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		}
+	}
+}
+
+// newKubernetesClient connects to the cluster of the kubeconfig at path. With
+// no path it is the cluster the gateway runs in, else the kubeconfig of
+// KUBECONFIG or ~/.kube/config.
+func newKubernetesClient(path string) (*kubernetesClient, error) {
+	if path == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inClusterClient()
+	}
+	if path == "" {
+		path = strings.Split(os.Getenv("KUBECONFIG"), string(os.PathListSeparator))[0]
+	}
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+	return kubeconfigClient(path)
+}
+
+func inClusterClient() (*kubernetesClient, error) {
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the ca of the cluster. error=%v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid ca of the cluster")
+	}
+	namespace, _ := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	return &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")),
+		namespace: strings.TrimSpace(string(namespace)),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client:    &http.Client{Transport: kubernetesTransport(&tls.Config{RootCAs: pool})},
+	}, nil
+}
+
+func kubeconfigClient(path string) (*kubernetesClient, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig. error=%v", err)
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig %s. error=%v", path, err)
+	}
+	dir := filepath.Dir(path)
+
+	c := &kubernetesClient{}
+	var clusterName, userName string
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext {
+			clusterName, userName, c.namespace = context.Context.Cluster, context.Context.User, context.Context.Namespace
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("invalid kubeconfig %s: no context %s", path, config.CurrentContext)
+	}
+
+	tlsConfig := &tls.Config{}
+	found := false
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		found = true
+		c.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err := fileOrData(dir, cluster.Cluster.CertificateAuthority, cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate authority of cluster %s. error=%v", clusterName, err)
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid certificate authority of cluster %s", clusterName)
+			}
+		}
+	}
+	if !found || c.server == "" {
+		return nil, fmt.Errorf("invalid kubeconfig %s: no server of cluster %s", path, clusterName)
+	}
+
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		if user.User.Exec != nil || user.User.AuthProvider != nil {
+			return nil, fmt.Errorf("credentials of user %s are not supported, only tokens, certificates and passwords", userName)
+		}
+		c.token, c.username, c.password = user.User.Token, user.User.Username, user.User.Password
+		if user.User.TokenFile != "" {
+			c.tokenFile = resolvePath(dir, user.User.TokenFile)
+		}
+		cert, err := fileOrData(dir, user.User.ClientCertificate, user.User.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate of user %s. error=%v", userName, err)
+		}
+		key, err := fileOrData(dir, user.User.ClientKey, user.User.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client key of user %s. error=%v", userName, err)
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate of user %s. error=%v", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	c.client = &http.Client{Transport: kubernetesTransport(tlsConfig)}
+	return c, nil
+}
+
+func kubernetesTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: kubernetesTimeout,
+		DialContext:         (&net.Dialer{Timeout: kubernetesTimeout}).DialContext,
+	}
+}
+
+// fileOrData returns the base64 data of a kubeconfig, else the content of
+// file, else nil.
+func fileOrData(dir string, file string, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(resolvePath(dir, file))
+	}
+	return nil, nil
+}
+
+// resolvePath resolves the paths of a kubeconfig from its directory.
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// do sends request to the api server with the credentials of the client.
+func (c *kubernetesClient) do(request *http.Request) (*http.Response, error) {
+	token := c.token
+	if c.tokenFile != "" {
+		// tokens of service accounts are rotated, so the file is read again
+		content, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token. error=%v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if c.username != "" {
+		request.SetBasicAuth(c.username, c.password)
+	}
+	request.Header.Set("Accept", "application/json")
+	return c.client.Do(request)
+}
@@ -0,0 +1,321 @@
+package servicediscovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kubernetesWatchTimeout is how long the api server keeps a watch open
+	kubernetesWatchTimeout = 5 * time.Minute
+	kubernetesMinBackoff   = time.Second
+	kubernetesMaxBackoff   = time.Minute
+)
+
+// errResourceGone is returned when the resource version of a watch is too
+// old, so the slices are listed again.
+var errResourceGone = errors.New("resource version is gone")
+
+// KubernetesServiceDiscovery watches the EndpointSlices of a service.
+type KubernetesServiceDiscovery struct {
+	config    Discovery
+	api       *kubernetesClient
+	namespace string
+	path      string
+
+	mtx       sync.RWMutex
+	slices    map[string]endpointSlice
+	endpoints []Endpoint
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		Zone string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (discovery *KubernetesServiceDiscovery) Endpoints() ([]Endpoint, error) {
+	discovery.mtx.RLock()
+	defer discovery.mtx.RUnlock()
+
+	if len(discovery.endpoints) < 1 {
+		return nil, fmt.Errorf("no endpoint discovered for service %s/%s", discovery.namespace, discovery.config.Service)
+	}
+	endpoints := make([]Endpoint, len(discovery.endpoints))
+	copy(endpoints, discovery.endpoints)
+	return endpoints, nil
+}
+
+// Close stops watching the service.
+func (discovery *KubernetesServiceDiscovery) Close() error {
+	discovery.cancel()
+	<-discovery.done
+	return nil
+}
+
+func (discovery *KubernetesServiceDiscovery) setConfig(config Discovery) (err error) {
+	if config.Service == "" {
+		return fmt.Errorf("invalid config: no service to discover in kubernetes")
+	}
+	api, err := newKubernetesClient(config.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = api.namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	discovery.config = config
+	discovery.api = api
+	discovery.namespace = namespace
+	discovery.path = api.server + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/endpointslices"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	discovery.cancel = cancel
+	discovery.done = make(chan struct{})
+	resourceVersion, err := discovery.list(ctx)
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to discover service %s/%s in kubernetes", namespace, config.Service)
+	}
+	go discovery.watch(ctx, resourceVersion)
+	return nil
+}
+
+// watch follows the changes of the slices from resourceVersion, listing
+// them again when there is no resource version to follow, until ctx is
+// cancelled. The last endpoints are kept while the api server fails.
+func (discovery *KubernetesServiceDiscovery) watch(ctx context.Context, resourceVersion string) {
+	defer close(discovery.done)
+	backoff := kubernetesMinBackoff
+	for ctx.Err() == nil {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = discovery.list(ctx)
+		} else {
+			resourceVersion, err = discovery.follow(ctx, resourceVersion)
+		}
+		if err == errResourceGone {
+			logrus.Debugf("listing endpoint slices of service %s/%s again", discovery.namespace, discovery.config.Service)
+			resourceVersion = ""
+			continue
+		}
+		if err == nil {
+			backoff = kubernetesMinBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Warnf("unable to watch service %s/%s in kubernetes", discovery.namespace, discovery.config.Service)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > kubernetesMaxBackoff {
+			backoff = kubernetesMaxBackoff
+		}
+	}
+}
+
+// list replaces the slices with the ones of the api server and returns
+// their resource version.
+func (discovery *KubernetesServiceDiscovery) list(ctx context.Context) (string, error) {
+	response, err := discovery.get(ctx, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var list endpointSliceList
+	if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("invalid endpoint slices. error=%v", err)
+	}
+
+	slices := make(map[string]endpointSlice)
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	discovery.mtx.Lock()
+	defer discovery.mtx.Unlock()
+	discovery.slices = slices
+	discovery.update()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// follow applies the changes of the slices after resourceVersion until the
+// api server ends the watch, and returns the last resource version.
+func (discovery *KubernetesServiceDiscovery) follow(ctx context.Context, resourceVersion string) (string, error) {
+	response, err := discovery.get(ctx, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(kubernetesWatchTimeout / time.Second))},
+	})
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			return resourceVersion, nil
+		} else if err != nil {
+			return resourceVersion, err
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int
+				Message string
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return "", errResourceGone
+			}
+			return resourceVersion, fmt.Errorf("watch failed: %s", status.Message)
+		}
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return resourceVersion, fmt.Errorf("invalid endpoint slice. error=%v", err)
+		}
+		resourceVersion = slice.Metadata.ResourceVersion
+
+		discovery.mtx.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			discovery.slices[slice.Metadata.Name] = slice
+			discovery.update()
+		case "DELETED":
+			delete(discovery.slices, slice.Metadata.Name)
+			discovery.update()
+		}
+		discovery.mtx.Unlock()
+	}
+}
+
+// get lists or watches the slices of the service.
+func (discovery *KubernetesServiceDiscovery) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+discovery.config.Service)
+	request, err := http.NewRequest("GET", discovery.path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := discovery.api.do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusGone {
+			return nil, errResourceGone
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("kubernetes responded %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return response, nil
+}
+
+// update computes the endpoints of the slices. The ready endpoints are
+// used, or if none is ready the terminating ones which still serve, so
+// requests are not refused while the service rolls out. mtx must be held.
+func (discovery *KubernetesServiceDiscovery) update() {
+	names := make([]string, 0, len(discovery.slices))
+	for name := range discovery.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ready, serving []Endpoint
+	for _, name := range names {
+		slice := discovery.slices[name]
+		port, ok := slicePort(slice, discovery.config.PortName)
+		if !ok {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if len(e.Addresses) == 0 {
+				continue
+			}
+			endpoint := Endpoint{IP: e.Addresses[0], Port: port, Weight: 1, Zone: e.Zone}
+			// unknown conditions are taken as ready
+			isReady := e.Conditions.Ready == nil || *e.Conditions.Ready
+			isServing := e.Conditions.Serving == nil && isReady || e.Conditions.Serving != nil && *e.Conditions.Serving
+			if isReady {
+				ready = append(ready, endpoint)
+			} else if isServing && e.Conditions.Terminating != nil && *e.Conditions.Terminating {
+				serving = append(serving, endpoint)
+			}
+		}
+	}
+	if len(ready) == 0 {
+		ready = serving
+	}
+	if len(ready) != len(discovery.endpoints) {
+		logrus.Debugf("discovered %d endpoints of service %s/%s", len(ready), discovery.namespace, discovery.config.Service)
+	}
+	discovery.endpoints = ready
+}
+
+// slicePort returns the port named name of slice. An unnamed port is also
+// the port of a slice with only one port.
+func slicePort(slice endpointSlice, name string) (int, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		portName := ""
+		if port.Name != nil {
+			portName = *port.Name
+		}
+		if portName == name || name == "" && len(slice.Ports) == 1 {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,194 @@
+package servicediscovery
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+const webSlice = `{
+	"metadata": {"name": "web-1", "resourceVersion": "10"},
+	"ports": [{"name": "http", "port": 8080}, {"name": "metrics", "port": 9090}],
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "zone": "a"},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+		{"addresses": ["10.0.0.3"], "conditions": {}}
+	]
+}`
+
+// fakeKubernetes serves the endpoint slices of the web service in the shop
+// namespace and streams events to the watches.
+type fakeKubernetes struct {
+	lists   int32
+	watches chan url.Values
+	events  chan string
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" ||
+		r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Query().Get("watch") == "" {
+		atomic.AddInt32(&k.lists, 1)
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, webSlice)
+		return
+	}
+	k.watches <- r.URL.Query()
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-k.events:
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeKubeconfig(t *testing.T, dir string, server string, cluster string, user string) string {
+	path := filepath.Join(dir, "config")
+	err := ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: other
+  context: {cluster: other, user: other}
+- name: test
+  context: {cluster: test, user: test, namespace: shop}
+clusters:
+- name: test
+  cluster:
+    server: %s
+%s
+users:
+- name: test
+  user:
+%s
+`, server, cluster, user)), 0600)
+	assert.NoError(t, err)
+	return path
+}
+
+func ips(d ServiceDiscovery) []string {
+	endpoints, _ := d.Endpoints()
+	var ips []string
+	for _, e := range endpoints {
+		ips = append(ips, e.IP)
+	}
+	return ips
+}
+
+func TestKubernetesServiceDiscovery(t *testing.T) {
+	k := &fakeKubernetes{watches: make(chan url.Values, 10), events: make(chan string)}
+	server := httptest.NewServer(k)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "kubeconfig")
+	defer os.RemoveAll(dir)
+	kubeconfig := writeKubeconfig(t, dir, server.URL, "", "    token: secret")
+
+	d, err := New(Discovery{Type: "kubernetes", Service: "web", PortName: "http", Kubeconfig: kubeconfig})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.(*KubernetesServiceDiscovery).Close()
+
+	endpoints, err := d.Endpoints()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{IP: "10.0.0.1", Port: 8080, Weight: 1, Zone: "a"},
+		{IP: "10.0.0.3", Port: 8080, Weight: 1},
+	}, endpoints)
+	watch := <-k.watches
+	assert.Equal(t, "10", watch.Get("resourceVersion"))
+
+	// terminating endpoints serve only while none is ready
+	k.events <- `{"type": "MODIFIED", "object": {"metadata": {"name": "web-1", "resourceVersion": "11"}, "ports": [{"name": "http", "port": 8080}],
+		"endpoints": [{"addresses": ["10.0.0.4"], "conditions": {"ready": false, "serving": true, "terminating": true}}]}}`
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.4"}, ips(d)) }))
+	k.events <- `{"type": "ADDED", "object": {"metadata": {"name": "web-2", "resourceVersion": "12"}, "ports": [{"name": "http", "port": 8080}],
+		"endpoints": [{"addresses": ["10.0.0.5"], "conditions": {"ready": true}}]}}`
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.5"}, ips(d)) }))
+	k.events <- `{"type": "DELETED", "object": {"metadata": {"name": "web-2", "resourceVersion": "13"}}}`
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.4"}, ips(d)) }))
+
+	// an expired resource version lists the slices again
+	k.events <- `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt32(&k.lists) == 2 }))
+	assert.True(t, waitFor(func() bool { return assert.ObjectsAreEqual([]string{"10.0.0.1", "10.0.0.3"}, ips(d)) }))
+}
+
+func TestKubernetesServiceDiscoveryPort(t *testing.T) {
+	k := &fakeKubernetes{watches: make(chan url.Values, 10), events: make(chan string)}
+	server := httptest.NewServer(k)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "kubeconfig")
+	defer os.RemoveAll(dir)
+	kubeconfig := writeKubeconfig(t, dir, server.URL, "", "    token: secret")
+
+	// the slice has more than one port, so an unnamed port does not match
+	d, err := New(Discovery{Type: "kubernetes", Service: "web", Kubeconfig: kubeconfig})
+	if assert.NoError(t, err) {
+		_, err = d.Endpoints()
+		assert.EqualError(t, err, "no endpoint discovered for service shop/web")
+		d.(*KubernetesServiceDiscovery).Close()
+	}
+
+	d, err = New(Discovery{Type: "kubernetes", Service: "web", PortName: "metrics", Kubeconfig: kubeconfig})
+	if assert.NoError(t, err) {
+		endpoints, _ := d.Endpoints()
+		if assert.Len(t, endpoints, 2) {
+			assert.Equal(t, 9090, endpoints[0].Port)
+		}
+		d.(*KubernetesServiceDiscovery).Close()
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "kubeconfig")
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("rotated\n"), 0600))
+
+	path := writeKubeconfig(t, dir, server.URL,
+		"    certificate-authority-data: "+base64.StdEncoding.EncodeToString(ca),
+		"    tokenFile: token")
+	c, err := newKubernetesClient(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "shop", c.namespace)
+	request, _ := http.NewRequest("GET", c.server, nil)
+	response, err := c.do(request)
+	if assert.NoError(t, err) {
+		response.Body.Close()
+		assert.Equal(t, "Bearer rotated", authorization)
+	}
+
+	path = writeKubeconfig(t, dir, server.URL, "", "    exec: {command: aws}")
+	_, err = newKubernetesClient(path)
+	assert.EqualError(t, err, "credentials of user test are not supported, only tokens, certificates and passwords")
+}
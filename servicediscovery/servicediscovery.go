@@ -21,6 +21,27 @@ func New(config Discovery) (ServiceDiscovery, error) {
 			return nil, err
 		}
 		return d, nil
+	case "consul":
+		d := &ConsulServiceDiscovery{}
+		err := d.setConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	case "kubernetes":
+		d := &KubernetesServiceDiscovery{}
+		err := d.setConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	case "file":
+		d := &FileServiceDiscovery{}
+		err := d.setConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
 	default:
 		return nil, fmt.Errorf("discovery type %s is not supported", config.Type)
 
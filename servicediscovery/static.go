@@ -4,23 +4,71 @@ import (
 	. "github.com/k3rn3l-p4n1c/apigateway"
 	"net"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type StaticServiceDiscovery struct {
-	config Discovery
-	ip     string
+	config    Discovery
+	endpoints []Endpoint
 }
 
-func (discovery *StaticServiceDiscovery) Get(_ string) (ip string, err error) {
-	return discovery.ip, nil
+func (discovery *StaticServiceDiscovery) Endpoints() ([]Endpoint, error) {
+	endpoints := make([]Endpoint, len(discovery.endpoints))
+	copy(endpoints, discovery.endpoints)
+	return endpoints, nil
 }
 
 func (discovery *StaticServiceDiscovery) setConfig(config Discovery) (err error) {
-	ip := net.ParseIP(discovery.config.Url)
-	if ip == nil {
-		return fmt.Errorf("invalid config: %s is not a valid IP", discovery.config.Url)
-	} else {
-		discovery.ip = ip.String()
-		return nil
+	discovery.config = config
+	discovery.endpoints = nil
+	if config.Url != "" {
+		host, port, err := splitAddress(config.Url)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("invalid config: %s is not a valid IP", config.Url)
+		}
+		discovery.endpoints = append(discovery.endpoints, Endpoint{IP: ip.String(), Port: port, Weight: 1})
 	}
+	for _, e := range config.Endpoints {
+		host, port, err := splitAddress(e.Address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		if e.Weight < 0 {
+			return fmt.Errorf("invalid config: weight of %s is negative", e.Address)
+		}
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+		discovery.endpoints = append(discovery.endpoints, Endpoint{IP: host, Port: port, Weight: e.Weight, Zone: e.Zone, Metadata: e.Metadata})
+	}
+	if len(discovery.endpoints) == 0 {
+		return fmt.Errorf("invalid config: no static endpoint")
+	}
+	return nil
+}
+
+// splitAddress splits a host or host:port. A missing port is 0.
+func splitAddress(address string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		// a host without port, or a bare ipv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		if host == "" || strings.ContainsAny(host, "[]") || strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", 0, fmt.Errorf("invalid config: %s is not a valid address", address)
+		}
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portString)
+	if host == "" || err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid config: %s is not a valid address", address)
+	}
+	return host, port, nil
 }
@@ -0,0 +1,42 @@
+package servicediscovery
+
+import (
+	"testing"
+
+	. "github.com/k3rn3l-p4n1c/apigateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticServiceDiscovery(t *testing.T) {
+	d, err := New(Discovery{Type: "static", Url: "10.0.0.1"})
+	if assert.NoError(t, err) {
+		endpoints, _ := d.Endpoints()
+		assert.Equal(t, []Endpoint{{IP: "10.0.0.1", Weight: 1}}, endpoints)
+	}
+
+	d, err = New(Discovery{Type: "static", Endpoints: []StaticEndpoint{
+		{Address: "10.0.0.1:8080", Weight: 9, Zone: "a"},
+		{Address: "[::1]:8081", Zone: "b", Metadata: map[string]string{"track": "canary"}},
+		{Address: "backend.local"},
+		{Address: "::2"},
+	}})
+	if assert.NoError(t, err) {
+		endpoints, _ := d.Endpoints()
+		assert.Equal(t, []Endpoint{
+			{IP: "10.0.0.1", Port: 8080, Weight: 9, Zone: "a"},
+			{IP: "::1", Port: 8081, Weight: 1, Zone: "b", Metadata: map[string]string{"track": "canary"}},
+			{IP: "backend.local", Weight: 1},
+			{IP: "::2", Weight: 1},
+		}, endpoints)
+	}
+
+	for _, config := range []Discovery{
+		{Type: "static", Url: "backend.local"},
+		{Type: "static"},
+		{Type: "static", Endpoints: []StaticEndpoint{{Address: "10.0.0.1:http"}}},
+		{Type: "static", Endpoints: []StaticEndpoint{{Address: "10.0.0.1", Weight: -1}}},
+	} {
+		_, err := New(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}